@@ -1,15 +1,15 @@
 package assertvalue
 
 import (
-	"bufio"
 	"fmt"
 	"github.com/MakeNowJust/heredoc"
-	"github.com/mattn/go-tty"
 	"github.com/pmezard/go-difflib/difflib"
-	"io/ioutil"
+	"go/format"
 	"log"
+	"net/url"
 	"os"
-	"regexp"
+	"path/filepath"
+	"reflect"
 	"runtime"
 	"strings"
 	"testing"
@@ -17,96 +17,74 @@ import (
 
 const maxInt = int(^uint(0) >> 1)
 
-var (
-	// See init() for comments
-	recurringAnswer string
-	isInteractive   bool
-	acceptNewValues bool
-	reCodeNoExp     *regexp.Regexp
-	reCodeExpBegin  *regexp.Regexp
-	reCodeExpEnd    *regexp.Regexp
-	fileChanges     map[string]map[int]int
-	prompts         []string
-)
+// State shared by all sessions. See state for comments
+var shared = newState()
 
-func init() {
-	isInteractive = true
-	acceptNewValues = false
-	for _, arg := range os.Args {
-		switch arg {
-		case "-nointeractive":
-			isInteractive = false
-		case "-accept":
-			acceptNewValues = true
-		}
-	}
-	// Parse "-promts nnnyyy" or "-prompts=nnnyyy" argument
-	rePrompts := regexp.MustCompile(`-prompts(\s+|=)(.*)(\s|$)`)
-	parsed := rePrompts.FindAllStringSubmatch(strings.Join(os.Args, " "), -1)
-	if len(parsed) > 0 {
-		prompts = strings.Split(parsed[0][2], "")
-	}
-	// Match assertValie.String call without expected
-	reCodeNoExp = regexp.MustCompile(`^(\s*)(assertvalue\.String\(.*)(\))`)
-	// Match first line of assertValie.String call with expected following
-	reCodeExpBegin = regexp.MustCompile("^(\\s*)(assertvalue\\.String\\(.*,\\s*`)$")
-	// Match closing `) after expected value in assertvalue.String call
-	// Compliment to reCodeExpBegin
-	reCodeExpEnd = regexp.MustCompile("^\\s*`\\s*\\)")
-	// Keep tracking of changes in test code
-	// Changing expected may change the number of lines in test code
-	// and runtime.Caller returns initial file line numbers
-	// We keep line number changes here in the form of offsets
-	// fileChanges[filename][line] => offset
-	fileChanges = make(map[string]map[int]int)
+// File compares actual value with the content of golden file.
+// Missing golden file is treated as empty one
+func File(t testing.TB, actual, filename string) {
+	t.Helper()
+	newSession(t).checkFile("File", actual, filename)
 }
 
-func File(t *testing.T, actual, filename string) {
-	var expected string
-	if _, err := os.Stat(filename); err == nil {
-		// File exists. Use content as expected value
-		buf, err := ioutil.ReadFile(filename)
-		if err != nil {
-			log.Fatal(err)
-		}
-		expected = string(buf)
-	} else if os.IsNotExist(err) {
-		// File does not exist. Will create file
-		expected = ""
-	} else {
-		// Something happened
-		log.Fatal(err)
-	}
-	if actual != expected {
-		diffStruct := difflib.UnifiedDiff{
-			A:        difflib.SplitLines(expected),
-			B:        difflib.SplitLines(actual),
-			FromFile: "file: " + filename,
-			ToFile:   "actual",
-			Context:  3,
-		}
-		diff, _ := difflib.GetUnifiedDiffString(diffStruct)
-		if !isNewValueAccepted(diff) {
-			t.FailNow()
-		} else {
-			err := ioutil.WriteFile(filename, []byte(actual), 0644)
-			if err != nil {
-				log.Fatal(err)
-			}
-		}
-	}
+// CheckFile is like File but does not stop the test on mismatch.
+// Marks the test as failed and returns false instead
+func CheckFile(t testing.TB, actual, filename string) bool {
+	t.Helper()
+	return newSession(t).checkFile("CheckFile", actual, filename)
 }
 
-func String(t *testing.T, args ...string) {
-	var actual, expected string
+func String(t testing.TB, args ...string) {
+	t.Helper()
+	checkStringArgs(t, args)
+	newSession(t).assertString("String", args[0], args[1:])
+}
 
-	if len(args) == 1 {
-		actual = args[0]
-		expected = ""
-	} else if len(args) == 2 {
-		actual = args[0]
-		expected = heredoc.Doc(args[1])
-	} else {
+// CheckString is like String but does not stop the test on mismatch.
+// Marks the test as failed and returns false instead
+func CheckString(t testing.TB, args ...string) bool {
+	t.Helper()
+	checkStringArgs(t, args)
+	return newSession(t).assertString("CheckString", args[0], args[1:])
+}
+
+// Value compares pretty printed actual value with expected heredoc.
+// Pretty printer output is stable: map keys are sorted, pointers are
+// dereferenced and struct fields are printed one per line
+func Value(t testing.TB, actual interface{}, expected ...string) {
+	t.Helper()
+	checkValueArgs(t, expected)
+	newSession(t).assertString("Value", prettyPrint(actual), expected)
+}
+
+// CheckValue is like Value but does not stop the test on mismatch.
+// Marks the test as failed and returns false instead
+func CheckValue(t testing.TB, actual interface{}, expected ...string) bool {
+	t.Helper()
+	checkValueArgs(t, expected)
+	return newSession(t).assertString("CheckValue", prettyPrint(actual), expected)
+}
+
+// Equal compares actual and expected values with reflect.DeepEqual.
+// Unlike Value the expected value is a Go expression. On accept it is
+// written to the test code as Go literal generated from actual value
+//
+//	assertvalue.Equal(t, users, []User{{Name: "John", Age: 33}})
+func Equal(t testing.TB, actual interface{}, expected ...interface{}) {
+	t.Helper()
+	newSession(t).checkEqual("Equal", actual, expected)
+}
+
+// CheckEqual is like Equal but does not stop the test on mismatch.
+// Marks the test as failed and returns false instead
+func CheckEqual(t testing.TB, actual interface{}, expected ...interface{}) bool {
+	t.Helper()
+	return newSession(t).checkEqual("CheckEqual", actual, expected)
+}
+
+func checkStringArgs(t testing.TB, args []string) {
+	t.Helper()
+	if len(args) != 1 && len(args) != 2 {
 		t.Fatal(heredoc.Doc(`
 			Invalid function call
 
@@ -120,181 +98,345 @@ func String(t *testing.T, args ...string) {
 
 		`))
 	}
+}
 
-	// Since we use heredocs to store values and heredoc always ends with
-	// new line character we should add do something with values
-	// which don't end wuth new lines. For now indicate missing new line
-	// with <NOEOL>\n
-	if actual == "" || actual[len(actual)-1:] != "\n" {
-		actual = actual + "<NOEOL>\n"
+func checkValueArgs(t testing.TB, expected []string) {
+	t.Helper()
+	if len(expected) > 1 {
+		t.Fatal(heredoc.Doc(`
+			Invalid function call
+
+			assertvalue.Value supports only two forms:
+
+			assertvalue.Value(t, actual)
+			assertvalue.Value(t, actual, expected)
+		`))
 	}
+}
 
+// The following functions implement assertions and must be called
+// directly from the public functions and methods because caller
+// position is used to find the call in the test code
+
+func (s *Session) checkFile(name, actual, filename string) bool {
+	s.t.Helper()
+	expected, exists, err := readGolden(filename)
+	if err != nil {
+		log.Fatal(err)
+	}
 	if actual != expected {
 		diffStruct := difflib.UnifiedDiff{
-			A:       difflib.SplitLines(expected),
-			B:       difflib.SplitLines(actual),
-			Context: 3,
-		}
-		diff, _ := difflib.GetUnifiedDiffString(diffStruct)
-		if !isNewValueAccepted(diff) {
-			t.FailNow()
-		} else {
-			_, filename, lineNum, _ := runtime.Caller(1)
-			lineNumOrig := lineNum
-			lineNum = currentLineNumber(filename, lineNum)
-			code := readTestCode(filename)
-			offset := 0
-			if len(args) == 1 {
-				code, offset = createExpected(code, lineNum, actual)
-			} else {
-				code, offset = updateExpected(code, lineNum, actual, t)
-			}
-			if offset != 0 {
-				updateLineNumbers(filename, lineNumOrig, offset)
-			}
-			writeTestCode(filename, code)
+			A:        difflib.SplitLines(expected),
+			B:        difflib.SplitLines(actual),
+			FromFile: "file: " + filename,
+			ToFile:   "actual",
+			Context:  3,
 		}
+		m := s.newMismatch(name, 1)
+		m.Golden, _ = filepath.Abs(filename)
+		m.New = !exists
+		m.Expected = expected
+		m.Actual = actual
+		m.Diff, _ = difflib.GetUnifiedDiffString(diffStruct)
+		return s.check(m)
 	}
+	return true
 }
 
-func isNewValueAccepted(diff string) bool {
-	fmt.Println(diff)
-	var answer string
-	if isInteractive && testing.Verbose() {
-		if recurringAnswer != "" {
-			answer = recurringAnswer
-		} else {
-			fmt.Print("Accept new value? [y,n,Y,N] ")
-			if len(prompts) > 0 {
-				answer, prompts = prompts[0], prompts[1:]
-				fmt.Println(answer)
-			} else {
-				// testing framework changes os.Stdin
-				// We need real interaction with user
-				tty, err := tty.Open()
-				if err != nil {
-					log.Fatal(err)
-				}
-				defer tty.Close()
-				answer, err = tty.ReadString()
-				if err != nil {
-					log.Fatal(err)
-				}
-			}
-			if answer == "Y" || answer == "N" {
-				recurringAnswer = answer
-			}
+func (s *Session) assertString(name, actual string, args []string) bool {
+	s.t.Helper()
+	var expected string
+	if len(args) == 1 {
+		wrapped := false
+		if !strings.HasPrefix(args[0], "\n") && strings.Contains(args[0], "<") {
+			// Markers may be decoded only if heredoc is wrapped
+			_, filename, lineNum, _ := runtime.Caller(2)
+			wrapped = isExpectedWrapped(filename, lineNum, name, s.method)
 		}
-		return answer == "y" || answer == "Y"
-	} else if acceptNewValues {
-		return true
-	} else {
-		return false
+		expected = decodeExpected(args[0], wrapped)
 	}
+
+	if len(args) == 0 || actual != expected {
+		// Values are compared as is but shown as heredoc content with
+		// markers of characters heredoc can't keep
+		var expectedText string
+		if len(args) == 1 {
+			expectedText = markText(expected)
+		}
+		actualText := markText(actual)
+		diffStruct := difflib.UnifiedDiff{
+			A:       difflib.SplitLines(expectedText),
+			B:       difflib.SplitLines(actualText),
+			Context: 3,
+		}
+		m := s.newMismatch(name, 1)
+		m.New = len(args) == 0
+		m.Expected = expectedText
+		m.Actual = actualText
+		m.Diff, _ = difflib.GetUnifiedDiffString(diffStruct)
+		return s.check(m)
+	}
+	return true
 }
 
-func readTestCode(filename string) []string {
-	var lines []string
-	f, err := os.Open(filename)
+// isExpectedWrapped returns true if expected argument of the assertion
+// called at lineNum of filename is wrapped with heredoc.Doc or D.
+// Argument may be a constant or variable initialized with wrapped heredoc
+func isExpectedWrapped(filename string, lineNum int, name string, method bool) bool {
+	shared.mu.Lock()
+	defer shared.mu.Unlock()
+	src, err := readTestCode(filename)
 	if err != nil {
-		log.Fatal(err)
+		return false
 	}
-	defer f.Close()
-	s := bufio.NewScanner(f)
-	for s.Scan() {
-		lines = append(lines, s.Text())
+	code, err := parseTestCode(filename, src)
+	if err != nil {
+		return false
+	}
+	call, err := code.findCall(shared.currentLineNumber(filename, lineNum), name, method)
+	if err != nil || !hasExpected(call, method) {
+		return false
 	}
-	err = s.Err()
+	decl, expr, err := code.expectedLiteral(call)
 	if err != nil {
-		log.Fatal(err)
+		return false
 	}
-	return lines
+	_, wrapped := decl.unwrapDoc(expr)
+	return wrapped
 }
 
-func writeTestCode(filename string, code []string) {
-	f, err := os.Create(filename)
-	if err != nil {
-		log.Fatal(err)
+func (s *Session) checkEqual(name string, actual interface{}, expected []interface{}) bool {
+	s.t.Helper()
+	if len(expected) > 1 {
+		s.t.Fatal(heredoc.Doc(`
+			Invalid function call
+
+			assertvalue.Equal supports only two forms:
+
+			assertvalue.Equal(t, actual)
+			assertvalue.Equal(t, actual, expected)
+		`))
 	}
-	defer f.Close()
-	w := bufio.NewWriter(f)
-	for _, line := range code {
-		fmt.Fprintln(w, line)
+	if len(expected) == 1 && reflect.DeepEqual(actual, expected[0]) {
+		return true
 	}
-	err = w.Flush()
+
+	fatal := isFatal(name)
+	pc, filename, _, _ := runtime.Caller(2)
+	pkgPath := funcPkgPath(runtime.FuncForPC(pc).Name())
+	names, err := shared.importNames(filename)
 	if err != nil {
-		log.Fatal(err)
+		return s.fail(fatal, err)
+	}
+	actualCode, imports, err := goLiteral(actual, pkgPath, names)
+	if err != nil {
+		return s.fail(fatal, err)
+	}
+	var expectedCode string
+	if len(expected) == 1 {
+		expectedCode, _, err = goLiteral(expected[0], pkgPath, names)
+		if err != nil {
+			return s.fail(fatal, err)
+		}
+		if expectedCode == actualCode {
+			return s.fail(fatal, fmt.Sprintf(
+				"Values are not equal but have the same Go literal\n"+
+					"actual:   %#v\nexpected: %#v", actual, expected[0]))
+		}
+	}
+
+	diffStruct := difflib.UnifiedDiff{
+		A:       difflib.SplitLines(formatLiteral(expectedCode)),
+		B:       difflib.SplitLines(formatLiteral(actualCode)),
+		Context: 3,
 	}
+	m := s.newMismatch(name, 1)
+	m.New = len(expected) == 0
+	m.Expected = expectedCode
+	m.Actual = actualCode
+	m.Imports = imports
+	m.Diff, _ = difflib.GetUnifiedDiffString(diffStruct)
+	return s.check(m)
 }
 
-func createExpected(code []string, lineNum int, actual string) ([]string, int) {
-	line := code[lineNum-1]
-	parsed := reCodeNoExp.FindAllStringSubmatch(line, -1)
-	indent := parsed[0][1]
-	prefix := parsed[0][2]
-	suffix := parsed[0][3]
-	expected := "`\n" +
-		formatExpectedContent(actual, indent) +
-		"\n" +
-		indent +
-		"`"
-	code[lineNum-1] = indent + prefix + ", " + expected + suffix
-	offset := strings.Count(expected, "\n")
-	return code, offset
+// funcPkgPath returns package import path from function name
+// returned by runtime.FuncForPC. The linker escapes dots and some other
+// characters of the last path element as %xx so the first dot after the
+// last slash ends the path
+func funcPkgPath(funcName string) string {
+	slash := strings.LastIndex(funcName, "/")
+	dot := strings.Index(funcName[slash+1:], ".")
+	pkgPath := funcName[:slash+1+dot]
+	if unescaped, err := url.PathUnescape(pkgPath); err == nil {
+		return unescaped
+	}
+	return pkgPath
 }
 
-func updateExpected(code []string, lineNum int, actual string, t *testing.T) ([]string, int) {
-	line := code[lineNum-1]
-	parsed := reCodeExpBegin.FindAllStringSubmatch(line, -1)
-	if len(parsed) != 1 {
-		t.Fatal(`Unable to parse expected from string` + "\n" + line)
-	}
-	indent := parsed[0][1]
-	// expected line number start/end
-	expStart := lineNum
-	expEnd := 0
-	for expEnd == 0 && lineNum < len(code) {
-		if reCodeExpEnd.Match([]byte(code[lineNum])) {
-			expEnd = lineNum
-		} else {
-			lineNum = lineNum + 1
+// formatLiteral formats Go literal for diff
+func formatLiteral(code string) string {
+	if code == "" {
+		return ""
+	}
+	formatted, err := format.Source([]byte(code))
+	if err != nil {
+		return code + "\n"
+	}
+	return string(formatted) + "\n"
+}
+
+// check asks user to accept new value and fails the test if it is
+// rejected. Accepted value is written to the test code or golden file.
+// Returns true if the value is accepted
+func (s *Session) check(m *Mismatch) bool {
+	s.t.Helper()
+	// Parallel tests must not prompt or rewrite files simultaneously
+	shared.mu.Lock()
+	defer shared.mu.Unlock()
+	callSite := m.callSite()
+	if value, ok := shared.acceptedValues[callSite]; ok && value == m.Actual {
+		return true
+	}
+	fatal := isFatal(m.Func)
+	actual := m.Actual
+	reporter := s.getReporter()
+	if m.Golden == "" {
+		rememberSource(m.Source)
+	}
+	if m.New && settings().strict {
+		reporter.Mismatch(m)
+		reporter.Rejected(m)
+		shared.missing = append(shared.missing, m)
+		return s.fail(fatal, missingMessage(m))
+	}
+	accepted := false
+	if !shared.skippedSites[callSite] {
+		var err error
+		accepted, err = s.isNewValueAccepted(m)
+		if err != nil {
+			return s.fail(fatal, err)
+		}
+	}
+	if !accepted {
+		reporter.Rejected(m)
+		if fatal {
+			s.t.FailNow()
+		}
+		s.t.Fail()
+		return false
+	}
+	err := m.accept()
+	if _, ok := err.(*verifyError); ok {
+		// Keep the accepted value to be reviewed later
+		if pendingErr := savePendingValue(reporter, m); pendingErr != nil {
+			return s.fail(fatal, pendingErr)
 		}
 	}
-	expected := formatExpectedContent(actual, indent)
-	newCode := make([]string, expStart)
-	copy(newCode, code[:expStart])
-	newCode = append(newCode, expected)
-	newCode = append(newCode, code[expEnd:]...)
-	offset := strings.Count(expected, "\n") - (expEnd - expStart - 1)
-	return newCode, offset
+	if err != nil {
+		return s.fail(fatal, err)
+	}
+	reporter.Accepted(m)
+	if m.Actual != actual {
+		// User edited the value or rejected some hunks. It is written
+		// as expected but still differs from actual value
+		shared.skippedSites[callSite] = true
+		return s.fail(fatal, "Accepted expected value differs from actual value")
+	}
+	shared.acceptedValues[callSite] = m.Actual
+	return true
 }
 
-func formatExpectedContent(s, indent string) string {
-	expected := heredoc.Docf(s)
-	lines := strings.Split(expected, "\n")
-	// cut empty last line
-	lines = lines[:len(lines)-1]
-	for i, line := range lines {
-		lines[i] = indent + "\t" + line
+// missingMessage returns error message of missing expected value
+func missingMessage(m *Mismatch) string {
+	if m.Golden != "" {
+		return "Snapshot missing: golden file " + relPath(m.Golden) + " does not exist"
 	}
-	return strings.Join(lines, "\n")
+	return "Snapshot missing: " + callName(m.Func, m.Method) + " has no expected value"
+}
+
+// callName returns name of assertion function or method for messages
+func callName(name string, method bool) string {
+	if method {
+		return name
+	}
+	return "assertvalue." + name
+}
+
+// isFatal returns false for Check* functions which do not stop the test
+func isFatal(name string) bool {
+	return !strings.HasPrefix(name, "Check")
 }
 
-func updateLineNumbers(filename string, lineNum, offset int) {
-	if fileChanges[filename] == nil {
-		fileChanges[filename] = make(map[int]int)
+// fail reports error and stops the test if fatal. Returns false
+func (s *Session) fail(fatal bool, args ...interface{}) bool {
+	s.t.Helper()
+	if fatal {
+		s.t.Fatal(args...)
 	}
-	fileChanges[filename][lineNum] = offset
+	s.t.Error(args...)
+	return false
 }
 
-func currentLineNumber(filename string, lineNum int) int {
-	cumulativeOffset := 0
-	if fileChanges[filename] != nil {
-		for num, offset := range fileChanges[filename] {
-			if lineNum > num {
-				cumulativeOffset = cumulativeOffset + offset
-			}
+// isNewValueAccepted reports the mismatch and asks prompter to accept
+// new value. Caller must hold shared.mu so only one prompt of the test
+// binary is active at a time. Test binaries of other packages are
+// coordinated with prompt lock file
+func (s *Session) isNewValueAccepted(m *Mismatch) (bool, error) {
+	reporter := s.getReporter()
+	prompter := s.getPrompter()
+	if settings().pending {
+		reporter.Mismatch(m)
+		return false, savePendingValue(reporter, m)
+	} else if !settings().isAcceptable(m) {
+		// Acceptance policy rejects the value without asking
+		reporter.Mismatch(m)
+		return false, nil
+	} else if isInteractive(prompter) {
+		if answer := recurringAnswer(m); answer != "" {
+			reporter.Mismatch(m)
+			return answer == "y", nil
+		}
+		unlock, err := lockPrompt(m.Source, !settings().noWait, func() {
+			reporter.Waiting(m)
+		})
+		if err != nil {
+			return false, err
+		}
+		reporter.Mismatch(m)
+		if unlock == nil {
+			// Another test binary is prompting and we do not wait
+			return false, savePendingValue(reporter, m)
 		}
+		defer unlock()
+		return prompter.Prompt(m)
+	}
+	reporter.Mismatch(m)
+	return settings().accept != "", nil
+}
+
+// savePendingValue saves mismatch as pending record to be reviewed later
+func savePendingValue(reporter Reporter, m *Mismatch) error {
+	dir := settings().pendingDir
+	if dir == "" {
+		dir = PendingDir(filepath.Dir(m.Source))
+	}
+	filename, err := savePending(dir, m)
+	if err != nil {
+		return err
+	}
+	reporter.Pending(m, filename)
+	return nil
+}
+
+// relPath returns path relative to current directory if possible
+func relPath(path string) string {
+	wd, err := os.Getwd()
+	if err != nil {
+		return path
+	}
+	rel, err := filepath.Rel(wd, path)
+	if err != nil {
+		return path
 	}
-	return lineNum + cumulativeOffset
+	return rel
 }
@@ -0,0 +1,300 @@
+package assertvalue
+
+import (
+	"flag"
+	"github.com/mattn/go-tty"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Settings of the test run. Every setting is taken from the first of:
+//   - flag given to the test binary, i.e. -assertvalue.accept
+//   - environment variable, i.e. ASSERTVALUE_ACCEPT=1
+//   - legacy argument after "-args --", i.e. -accept
+//   - default value
+type config struct {
+	// Ask user to accept new values. Tests must also run in verbose mode
+	interactive bool
+	// Interactive mode is set explicitly. Otherwise it is turned off
+	// when CI environment variable is set or there is no terminal
+	interactiveSet bool
+	// Accept new values without asking in non-interactive mode:
+	// "all", "new" (only missing expected values) or "" (none)
+	accept string
+	// Acceptance policy. Only values of matching tests and files may be
+	// accepted. Other values are rejected without asking
+	acceptRun  *regexp.Regexp
+	acceptFile string
+	// Save mismatches as pending records to be reviewed later with
+	// "assertvalue review" instead of asking user
+	pending    bool
+	pendingDir string
+	// Do not wait while test binary of another package prompts user.
+	// Save mismatch as pending record instead
+	noWait bool
+	// Answers to prompts for ScriptedPrompter, i.e. "yyn"
+	prompts string
+	// Dry-run mode. Write changes of accepted values to this patch file
+	// instead of changing test code and golden files
+	patch string
+	// Refuse to rewrite files with unstaged changes in git work tree
+	// unless forced. Optionally stage rewritten files
+	git   bool
+	force bool
+	stage bool
+	// Fail on missing expected values and golden files instead of
+	// creating them. Useful on CI
+	strict bool
+}
+
+type configFlag struct {
+	name, env, usage string
+	bool             bool
+}
+
+// boolString is string flag which may be given without value like bool
+// flag. -name is the same as -name=true
+type boolString string
+
+func (b *boolString) String() string {
+	return string(*b)
+}
+
+func (b *boolString) Set(s string) error {
+	*b = boolString(s)
+	return nil
+}
+
+func (b *boolString) IsBoolFlag() bool {
+	return true
+}
+
+var configFlags = []configFlag{
+	{"interactive", "ASSERTVALUE_INTERACTIVE",
+		"ask to accept new values in verbose mode (default true unless CI is set or there is no terminal)", true},
+	{"accept", "ASSERTVALUE_ACCEPT",
+		"accept new values without asking in non-interactive mode: true, false or new", true},
+	{"accept-run", "ASSERTVALUE_ACCEPT_RUN",
+		"accept only values of tests matching this regexp", false},
+	{"accept-file", "ASSERTVALUE_ACCEPT_FILE",
+		"accept only values of test or golden files matching this glob", false},
+	{"pending", "ASSERTVALUE_PENDING",
+		"save new values to be reviewed later with assertvalue review", true},
+	{"pending-dir", "ASSERTVALUE_PENDING_DIR",
+		"save new values to be reviewed later to this directory", false},
+	{"nowait", "ASSERTVALUE_NOWAIT",
+		"do not wait while another test binary prompts, save new values as pending", true},
+	{"prompts", "ASSERTVALUE_PROMPTS",
+		"answer prompts with these keys instead of asking user", false},
+	{"patch", "ASSERTVALUE_PATCH",
+		"do not change files, write changes of accepted values to this patch file", false},
+	{"git", "ASSERTVALUE_GIT",
+		"refuse to rewrite files with unstaged changes in git work tree", true},
+	{"force", "ASSERTVALUE_FORCE",
+		"rewrite files with unstaged changes anyway", true},
+	{"stage", "ASSERTVALUE_STAGE",
+		"stage rewritten files with git add, implies -assertvalue.git", true},
+	{"strict", "ASSERTVALUE_STRICT",
+		"fail on missing expected values and golden files, never create them", true},
+}
+
+var (
+	cfg     config
+	cfgOnce sync.Once
+)
+
+func init() {
+	for _, f := range configFlags {
+		if f.name == "accept" {
+			flag.Var(new(boolString), "assertvalue."+f.name, f.usage)
+		} else if f.bool {
+			flag.Bool("assertvalue."+f.name, false, f.usage)
+		} else {
+			flag.String("assertvalue."+f.name, "", f.usage)
+		}
+	}
+}
+
+// settings returns settings of the test run. Flags are parsed by testing
+// package so settings must not be used before tests start
+func settings() *config {
+	cfgOnce.Do(func() {
+		values := legacyArgs()
+		for _, f := range configFlags {
+			if value, ok := os.LookupEnv(f.env); ok {
+				values[f.name] = value
+			}
+		}
+		if flag.Parsed() {
+			flag.Visit(func(fl *flag.Flag) {
+				if strings.HasPrefix(fl.Name, "assertvalue.") {
+					values[strings.TrimPrefix(fl.Name, "assertvalue.")] = fl.Value.String()
+				}
+			})
+		}
+		cfg = config{interactive: true}
+		if value, ok := values["interactive"]; ok {
+			cfg.interactive = parseBool("interactive", value)
+			cfg.interactiveSet = true
+		}
+		switch values["accept"] {
+		case "new":
+			cfg.accept = "new"
+		case "all":
+			cfg.accept = "all"
+		default:
+			if parseBool("accept", values["accept"]) {
+				cfg.accept = "all"
+			}
+		}
+		if value := values["accept-run"]; value != "" {
+			re, err := regexp.Compile(value)
+			if err != nil {
+				log.Fatalf("Invalid value %q of assertvalue.accept-run setting\n%s",
+					value, err)
+			}
+			cfg.acceptRun = re
+		}
+		cfg.acceptFile = values["accept-file"]
+		if _, err := filepath.Match(cfg.acceptFile, ""); err != nil {
+			log.Fatalf("Invalid value %q of assertvalue.accept-file setting\n%s",
+				cfg.acceptFile, err)
+		}
+		// Policy without accept mode means accept values it selects
+		if cfg.accept == "" && (cfg.acceptRun != nil || cfg.acceptFile != "") {
+			cfg.accept = "all"
+		}
+		cfg.pending = parseBool("pending", values["pending"])
+		cfg.pendingDir = values["pending-dir"]
+		if cfg.pendingDir != "" {
+			cfg.pending = true
+		}
+		cfg.noWait = parseBool("nowait", values["nowait"])
+		cfg.prompts = values["prompts"]
+		cfg.strict = parseBool("strict", values["strict"])
+		cfg.git = parseBool("git", values["git"])
+		cfg.force = parseBool("force", values["force"])
+		cfg.stage = parseBool("stage", values["stage"])
+		if cfg.stage {
+			cfg.git = true
+		}
+		if cfg.patch = values["patch"]; cfg.patch != "" {
+			// Tests may change current directory
+			path, err := filepath.Abs(cfg.patch)
+			if err != nil {
+				log.Fatal(err)
+			}
+			cfg.patch = path
+		}
+	})
+	return &cfg
+}
+
+// legacyArgs returns settings given as arguments after "-args --"
+func legacyArgs() map[string]string {
+	values := make(map[string]string)
+	for _, arg := range os.Args {
+		switch arg {
+		case "-nointeractive":
+			values["interactive"] = "false"
+		case "-accept":
+			values["accept"] = "true"
+		case "-pending":
+			values["pending"] = "true"
+		case "-nowait":
+			values["nowait"] = "true"
+		}
+		if strings.HasPrefix(arg, "-pending=") {
+			values["pending-dir"] = strings.TrimPrefix(arg, "-pending=")
+		}
+	}
+	// Parse "-promts nnnyyy" or "-prompts=nnnyyy" argument
+	rePrompts := regexp.MustCompile(`-prompts(\s+|=)(\S*)`)
+	parsed := rePrompts.FindAllStringSubmatch(strings.Join(os.Args, " "), -1)
+	if len(parsed) > 0 {
+		values["prompts"] = parsed[0][2]
+	}
+	return values
+}
+
+func parseBool(name, value string) bool {
+	if value == "" {
+		return false
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Fatalf("Invalid value %q of assertvalue.%s setting", value, name)
+	}
+	return b
+}
+
+// isAcceptable returns false if acceptance policy does not allow to
+// accept new value of the mismatch
+func (c *config) isAcceptable(m *Mismatch) bool {
+	if c.accept == "new" && !m.New {
+		return false
+	}
+	if c.acceptRun != nil && !c.acceptRun.MatchString(m.Test) {
+		return false
+	}
+	if c.acceptFile != "" && !matchFile(c.acceptFile, m.Source) &&
+		(m.Golden == "" || !matchFile(c.acceptFile, m.Golden)) {
+		return false
+	}
+	return true
+}
+
+// matchFile matches glob pattern against path relative to current
+// directory or against file name
+func matchFile(pattern, path string) bool {
+	for _, name := range []string{relPath(path), filepath.Base(path)} {
+		if ok, _ := filepath.Match(pattern, filepath.ToSlash(name)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// isInteractive returns true if prompter should be asked to accept new
+// values. Caller must hold shared.mu
+func isInteractive(p Prompter) bool {
+	c := settings()
+	if !c.interactive || !testing.Verbose() {
+		return false
+	}
+	if c.interactiveSet {
+		return true
+	}
+	// Only default prompter needs terminal
+	if kp, ok := p.(*keyPrompter); !ok || kp.scripted {
+		return true
+	}
+	if isCI() {
+		return false
+	}
+	if shared.hasTerminal == nil {
+		t, err := tty.Open()
+		if err == nil {
+			t.Close()
+		}
+		hasTerminal := err == nil
+		shared.hasTerminal = &hasTerminal
+	}
+	return *shared.hasTerminal
+}
+
+// isCI returns true if tests run by continuous integration service
+func isCI() bool {
+	value := os.Getenv("CI")
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return value != ""
+	}
+	return b
+}
@@ -0,0 +1,381 @@
+package assertvalue
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"github.com/pmezard/go-difflib/difflib"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Test code and golden files are read and written with the functions
+// below. In dry-run mode written files are kept in memory and their
+// changes are written as a patch instead. Caller must hold shared.mu
+
+// readTestCode returns test code with LF line endings, without BOM and
+// with final new line as go/format produces
+func readTestCode(filename string) ([]byte, error) {
+	src, err := readFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return detectEncoding(src).decode(src), nil
+}
+
+// writeTestCode writes test code in encoding of the current file
+func writeTestCode(filename string, code []byte, test string) error {
+	src, err := readFile(filename)
+	if err != nil {
+		return err
+	}
+	return writeFile(filename, detectEncoding(src).encode(code), test)
+}
+
+func writeGolden(filename string, content []byte, test string) error {
+	return writeFile(filename, content, test)
+}
+
+func readFile(filename string) ([]byte, error) {
+	if content, ok := shared.written[filename]; ok {
+		return content, nil
+	}
+	return ioutil.ReadFile(filename)
+}
+
+// readGolden returns content of golden file and false if it does not
+// exist. Does not require shared.mu to be held
+func readGolden(filename string) (string, bool, error) {
+	shared.mu.Lock()
+	defer shared.mu.Unlock()
+	path, err := filepath.Abs(filename)
+	if err != nil {
+		return "", false, err
+	}
+	if content, ok := shared.written[path]; ok {
+		return string(content), true, nil
+	}
+	buf, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, err
+	}
+	return string(buf), true, nil
+}
+
+// writeFile writes file content accepted by test and records the edit
+// in the journal
+func writeFile(filename string, content []byte, test string) error {
+	c := settings()
+	if c.patch != "" {
+		shared.written[filename] = content
+		if _, ok := shared.sources[filename]; ok {
+			shared.sources[filename] = sha1.Sum(content)
+		}
+		return writePatch(c.patch)
+	}
+	if c.git && !c.force && !shared.modified[filename] {
+		err := checkUnstaged(filename)
+		if err != nil {
+			return err
+		}
+	}
+	old, err := ioutil.ReadFile(filename)
+	created := os.IsNotExist(err)
+	if err != nil && !created {
+		return err
+	}
+	err = writeFileAtomic(filename, content)
+	if err != nil {
+		return err
+	}
+	shared.modified[filename] = true
+	if _, ok := shared.sources[filename]; ok {
+		shared.sources[filename] = sha1.Sum(content)
+	}
+	err = journalEdit(filename, old, content, created, test)
+	if err != nil {
+		return err
+	}
+	if c.stage {
+		_, err = git(filepath.Dir(filename), "add", "--", filepath.Base(filename))
+	}
+	return err
+}
+
+// writeFileAtomic writes content to a temporary file and renames it to
+// filename so the file is never written partially. File mode of existing
+// file is preserved. Symlink is not replaced, its target is written
+func writeFileAtomic(filename string, content []byte) error {
+	mode := os.FileMode(0644)
+	if target, err := filepath.EvalSymlinks(filename); err == nil {
+		filename = target
+		info, err := os.Stat(filename)
+		if err != nil {
+			return err
+		}
+		mode = info.Mode().Perm()
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(filename), "."+filepath.Base(filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(content)
+	if err == nil {
+		err = f.Chmod(mode)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), filename)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// Line endings, byte order mark and final new line of a text file
+type textEncoding struct {
+	bom   bool
+	crlf  bool
+	noEOL bool
+}
+
+var utf8BOM = []byte("\xef\xbb\xbf")
+
+// detectEncoding returns encoding of text. Line endings are CRLF only
+// if all lines end with CRLF. gofmt converts mixed line endings to LF
+func detectEncoding(text []byte) textEncoding {
+	bom := bytes.HasPrefix(text, utf8BOM)
+	text = bytes.TrimPrefix(text, utf8BOM)
+	crlf := bytes.Count(text, []byte("\r\n"))
+	return textEncoding{
+		bom:   bom,
+		crlf:  crlf > 0 && crlf == bytes.Count(text, []byte("\n")),
+		noEOL: len(text) > 0 && !bytes.HasSuffix(text, []byte("\n")),
+	}
+}
+
+// decode converts text to LF line endings without BOM ending with new
+// line
+func (e textEncoding) decode(text []byte) []byte {
+	text = bytes.TrimPrefix(text, utf8BOM)
+	if e.crlf {
+		text = bytes.Replace(text, []byte("\r\n"), []byte("\n"), -1)
+	}
+	if e.noEOL {
+		text = append(text[:len(text):len(text)], '\n')
+	}
+	return text
+}
+
+// encode converts text with LF line endings to the encoding
+func (e textEncoding) encode(text []byte) []byte {
+	if e.noEOL {
+		text = bytes.TrimSuffix(text, []byte("\n"))
+	}
+	if e.crlf {
+		text = bytes.Replace(text, []byte("\n"), []byte("\r\n"), -1)
+	}
+	if e.bom {
+		text = append(append([]byte{}, utf8BOM...), text...)
+	}
+	return text
+}
+
+// checkUnstaged returns error if file has changes in git work tree which
+// are not staged. Rewriting such file would lose them. Files which are
+// not in git work tree are not checked
+func checkUnstaged(filename string) error {
+	if gitRoot(filepath.Dir(filename)) == "" {
+		return nil
+	}
+	out, err := git(filepath.Dir(filename), "status", "--porcelain", "--",
+		filepath.Base(filename))
+	if err != nil {
+		return err
+	}
+	// Work tree status is the second character of "XY path"
+	if len(out) > 1 && out[1] != ' ' {
+		return fmt.Errorf("Refusing to rewrite %s with unstaged changes\n"+
+			"Stage them or use -assertvalue.force", relPath(filename))
+	}
+	return nil
+}
+
+// git runs git command in dir and returns its output
+func git(dir string, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return "", fmt.Errorf("git %s failed\n%s",
+			strings.Join(args, " "), exitErr.Stderr)
+	}
+	return string(out), err
+}
+
+// Header line of patch file. Test binaries started by the same "go test"
+// command have the same parent process so the header tells whether the
+// patch was written by this test run or it is left from earlier one
+const patchHeader = "# assertvalue patch of go test process %d\n"
+
+// writePatch writes changes of files written in dry-run mode to patch
+// file. Test binaries of several packages may write the same patch so
+// changes of files written by others in this test run are kept. Patch
+// left from earlier run is replaced
+func writePatch(patch string) error {
+	f, err := os.OpenFile(patch, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	err = lockFile(f)
+	if err != nil {
+		return err
+	}
+	defer unlockFile(f)
+	old, err := ioutil.ReadAll(f)
+	if err != nil {
+		return err
+	}
+
+	header := fmt.Sprintf(patchHeader, os.Getppid())
+	diffs := make(map[string]string)
+	if strings.HasPrefix(string(old), header) {
+		for _, diff := range splitPatch(string(old[len(header):])) {
+			diffs[patchPath(diff)] = diff
+		}
+	}
+	for filename, content := range shared.written {
+		path, diff, err := fileDiff(filename, content)
+		if err != nil {
+			return err
+		}
+		if diff == "" {
+			delete(diffs, path)
+		} else {
+			diffs[path] = diff
+		}
+	}
+	paths := make([]string, 0, len(diffs))
+	for path := range diffs {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	var buf bytes.Buffer
+	buf.WriteString(header)
+	for _, path := range paths {
+		buf.WriteString(diffs[path])
+	}
+
+	err = f.Truncate(0)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteAt(buf.Bytes(), 0)
+	return err
+}
+
+// fileDiff returns git diff of file written in dry-run mode and the file
+// path in the diff. Paths are relative to the root of git repository so
+// the patch can be applied with "git apply"
+func fileDiff(filename string, content []byte) (string, string, error) {
+	path := relSlashPath(patchRoot(filepath.Dir(filename)), filename)
+	old, err := ioutil.ReadFile(filename)
+	exists := err == nil
+	if err != nil && !os.IsNotExist(err) {
+		return "", "", err
+	}
+	if exists && bytes.Equal(old, content) {
+		return path, "", nil
+	}
+
+	a, b := patchLines(string(old)), patchLines(string(content))
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "diff --git a/%s b/%s\n", path, path)
+	if exists {
+		fmt.Fprintf(&buf, "--- a/%s\n", path)
+	} else {
+		buf.WriteString("new file mode 100644\n--- /dev/null\n")
+	}
+	fmt.Fprintf(&buf, "+++ b/%s\n", path)
+	for _, group := range difflib.NewMatcher(a, b).GetGroupedOpCodes(3) {
+		buf.WriteString(formatHunk(a, b, group))
+	}
+	return path, buf.String(), nil
+}
+
+// patchLines splits text into lines keeping new line characters
+func patchLines(s string) []string {
+	lines := strings.SplitAfter(s, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// splitPatch splits patch into diffs of separate files
+func splitPatch(patch string) []string {
+	var diffs []string
+	for _, line := range strings.SplitAfter(patch, "\n") {
+		if strings.HasPrefix(line, "diff --git ") || len(diffs) == 0 {
+			diffs = append(diffs, "")
+		}
+		diffs[len(diffs)-1] += line
+	}
+	if len(diffs) == 1 && diffs[0] == "" {
+		return nil
+	}
+	return diffs
+}
+
+// patchPath returns file path of the diff from its "diff --git" line
+func patchPath(diff string) string {
+	line := strings.SplitN(diff, "\n", 2)[0]
+	line = strings.TrimPrefix(line, "diff --git a/")
+	if i := strings.Index(line, " b/"); i >= 0 {
+		return line[:i]
+	}
+	return line
+}
+
+// patchRoot returns root of git repository containing dir or module
+// root if dir is not in repository
+func patchRoot(dir string) string {
+	if root := gitRoot(dir); root != "" {
+		return root
+	}
+	return moduleRoot(dir)
+}
+
+// gitRoot returns root of git work tree containing dir or "" if dir is
+// not in work tree
+func gitRoot(dir string) string {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return ""
+	}
+	for d := dir; ; {
+		if _, err := os.Stat(filepath.Join(d, ".git")); err == nil {
+			return d
+		}
+		parent := filepath.Dir(d)
+		if parent == d {
+			return ""
+		}
+		d = parent
+	}
+}
@@ -0,0 +1,417 @@
+package assertvalue
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"math"
+	"path"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Literal contexts. Define how much type information literal must contain
+const (
+	// Static type is unknown (top level value, interface field or element).
+	// Literal must contain full type
+	ctxInterface = iota
+	// Static type is known (struct field). Basic values may be untyped
+	ctxTyped
+	// Composite literal element. Type of composite literal may be elided
+	ctxElided
+)
+
+// Go literal writer generates Go expression which evaluates to the value
+// equal (reflect.DeepEqual) to the given one
+type literalWriter struct {
+	buf bytes.Buffer
+	// Import path of the package the literal is written for
+	pkgPath string
+	// Imports of the test file. Import path => import name ("" if the
+	// package is imported without explicit name)
+	names map[string]string
+	// Imports missing in the test file which literal needs.
+	// Import path => package name
+	imports  map[string]string
+	visiting map[uintptr]bool
+	err      error
+}
+
+// goLiteral returns Go source code of value and imports to add to the
+// test file to compile it
+func goLiteral(value interface{}, pkgPath string, names map[string]string) (string, map[string]string, error) {
+	w := &literalWriter{
+		pkgPath:  pkgPath,
+		names:    names,
+		imports:  make(map[string]string),
+		visiting: make(map[uintptr]bool),
+	}
+	if value == nil {
+		return "nil", w.imports, nil
+	}
+	// Copy value into addressable one so we can access unexported fields
+	v := reflect.ValueOf(value)
+	root := reflect.New(v.Type()).Elem()
+	root.Set(v)
+	w.value(root, ctxInterface)
+	return w.buf.String(), w.imports, w.err
+}
+
+func (w *literalWriter) fail(format string, args ...interface{}) {
+	if w.err == nil {
+		w.err = fmt.Errorf("Unable to write value as Go literal: "+format, args...)
+	}
+}
+
+func (w *literalWriter) value(v reflect.Value, ctx int) {
+	if w.err != nil {
+		return
+	}
+	if v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			w.buf.WriteString("nil")
+		} else {
+			w.value(v.Elem(), ctxInterface)
+		}
+		return
+	}
+	v = exported(v)
+	if v.Type() == timeType && v.CanInterface() {
+		w.time(v.Interface().(time.Time))
+		return
+	}
+	switch v.Kind() {
+	case reflect.Bool, reflect.String,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
+		reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64, reflect.Complex64, reflect.Complex128:
+		w.basic(v, ctx)
+	case reflect.Ptr:
+		if v.IsNil() {
+			w.nil(v.Type(), ctx)
+			return
+		}
+		elem := v.Elem()
+		switch elem.Kind() {
+		case reflect.Struct, reflect.Slice, reflect.Array, reflect.Map:
+		default:
+			w.fail("pointer to %s", v.Type().Elem())
+			return
+		}
+		if elem.Type() == timeType {
+			w.fail("pointer to %s", v.Type().Elem())
+			return
+		}
+		if w.visiting[v.Pointer()] {
+			w.fail("cycle through %s", v.Type())
+			return
+		}
+		w.visiting[v.Pointer()] = true
+		if ctx != ctxElided {
+			w.buf.WriteString("&")
+			ctx = ctxTyped
+		}
+		w.value(elem, ctx)
+		delete(w.visiting, v.Pointer())
+	case reflect.Struct:
+		w.compositeType(v.Type(), ctx)
+		w.buf.WriteString("{")
+		n := 0
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Type().Field(i)
+			if isZero(v.Field(i)) {
+				continue
+			}
+			if field.PkgPath != "" && field.PkgPath != w.pkgPath {
+				w.fail("unexported field %s of %s", field.Name, v.Type())
+				return
+			}
+			w.buf.WriteString("\n" + field.Name + ": ")
+			w.value(v.Field(i), ctxTyped)
+			w.buf.WriteString(",")
+			n++
+		}
+		w.close(n)
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			w.nil(v.Type(), ctx)
+			return
+		}
+		w.compositeType(v.Type(), ctx)
+		w.buf.WriteString("{")
+		multiline := !isBasic(v.Type().Elem())
+		for i := 0; i < v.Len(); i++ {
+			if multiline {
+				w.buf.WriteString("\n")
+			} else if i > 0 {
+				w.buf.WriteString(" ")
+			}
+			w.value(v.Index(i), ctxElided)
+			if multiline || i < v.Len()-1 {
+				w.buf.WriteString(",")
+			}
+		}
+		if multiline {
+			w.close(v.Len())
+		} else {
+			w.buf.WriteString("}")
+		}
+	case reflect.Map:
+		if v.IsNil() {
+			w.nil(v.Type(), ctx)
+			return
+		}
+		w.compositeType(v.Type(), ctx)
+		w.buf.WriteString("{")
+		for _, key := range sortedKeys(v) {
+			w.buf.WriteString("\n")
+			w.value(key, ctxElided)
+			w.buf.WriteString(": ")
+			w.value(v.MapIndex(key), ctxElided)
+			w.buf.WriteString(",")
+		}
+		w.close(v.Len())
+	default:
+		if isNil(v) {
+			w.nil(v.Type(), ctx)
+		} else {
+			w.fail("value of type %s", v.Type())
+		}
+	}
+}
+
+// basic writes value of basic kind. Outside of typed context the value
+// is converted to its type unless it is the default type of the constant
+func (w *literalWriter) basic(v reflect.Value, ctx int) {
+	var lit string
+	switch v.Kind() {
+	case reflect.Bool:
+		lit = strconv.FormatBool(v.Bool())
+	case reflect.String:
+		lit = strconv.Quote(v.String())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		lit = strconv.FormatInt(v.Int(), 10)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
+		reflect.Uint64, reflect.Uintptr:
+		lit = strconv.FormatUint(v.Uint(), 10)
+	case reflect.Float32, reflect.Float64:
+		lit = w.float(v.Float(), v.Type().Bits())
+	case reflect.Complex64, reflect.Complex128:
+		c := v.Complex()
+		bits := v.Type().Bits() / 2
+		lit = "complex(" + w.float(real(c), bits) + ", " + w.float(imag(c), bits) + ")"
+	}
+	if ctx == ctxInterface && !isDefaultType(v.Type()) {
+		lit = w.typ(v.Type()) + "(" + lit + ")"
+	}
+	w.buf.WriteString(lit)
+}
+
+func (w *literalWriter) float(f float64, bits int) string {
+	switch {
+	case math.IsInf(f, 1):
+		return w.qualifier("math", "math") + "Inf(1)"
+	case math.IsInf(f, -1):
+		return w.qualifier("math", "math") + "Inf(-1)"
+	case math.IsNaN(f):
+		return w.qualifier("math", "math") + "NaN()"
+	}
+	s := strconv.FormatFloat(f, 'g', -1, bits)
+	// Keep floating point literal floating point
+	if !strings.ContainsAny(s, ".e") {
+		s = s + ".0"
+	}
+	return s
+}
+
+func (w *literalWriter) time(t time.Time) {
+	var loc string
+	switch t.Location() {
+	case time.UTC:
+		loc = "UTC"
+	case time.Local:
+		loc = "Local"
+	default:
+		w.fail("time in location %s", t.Location())
+		return
+	}
+	q := w.qualifier("time", "time")
+	fmt.Fprintf(&w.buf, "%sDate(%d, %s%s, %d, %d, %d, %d, %d, %s%s)",
+		q, t.Year(), q, t.Month(), t.Day(),
+		t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), q, loc)
+}
+
+func (w *literalWriter) nil(t reflect.Type, ctx int) {
+	if ctx == ctxInterface {
+		w.buf.WriteString("(" + w.typ(t) + ")(nil)")
+	} else {
+		w.buf.WriteString("nil")
+	}
+}
+
+func (w *literalWriter) compositeType(t reflect.Type, ctx int) {
+	if ctx != ctxElided {
+		w.buf.WriteString(w.typ(t))
+	}
+}
+
+// close writes closing brace of multiline composite literal with n elements
+func (w *literalWriter) close(n int) {
+	if n > 0 {
+		w.buf.WriteString("\n")
+	}
+	w.buf.WriteString("}")
+}
+
+// typ returns Go source code of type
+func (w *literalWriter) typ(t reflect.Type) string {
+	if t.Name() != "" {
+		if t.PkgPath() == "" {
+			// Predeclared type
+			return t.Name()
+		}
+		if t.PkgPath() != w.pkgPath && !ast.IsExported(t.Name()) {
+			w.fail("unexported type %s", t)
+			return ""
+		}
+		// Named type String() is "<package name>.<type name>"
+		name := strings.SplitN(t.String(), ".", 2)[0]
+		return w.qualifier(t.PkgPath(), name) + t.Name()
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		return "*" + w.typ(t.Elem())
+	case reflect.Slice:
+		return "[]" + w.typ(t.Elem())
+	case reflect.Array:
+		return "[" + strconv.Itoa(t.Len()) + "]" + w.typ(t.Elem())
+	case reflect.Map:
+		return "map[" + w.typ(t.Key()) + "]" + w.typ(t.Elem())
+	case reflect.Interface:
+		if t.NumMethod() == 0 {
+			return "interface{}"
+		}
+	case reflect.Struct:
+		var fields []string
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			s := w.typ(f.Type)
+			if !f.Anonymous {
+				s = f.Name + " " + s
+			}
+			if f.Tag != "" {
+				s = s + " " + strconv.Quote(string(f.Tag))
+			}
+			fields = append(fields, s)
+		}
+		return "struct{ " + strings.Join(fields, "; ") + " }"
+	}
+	w.fail("type %s", t)
+	return ""
+}
+
+// qualifier returns "<import name>." for the package or "" if package
+// is the test file package or dot imported
+func (w *literalWriter) qualifier(pkgPath, pkgName string) string {
+	if pkgPath == w.pkgPath {
+		return ""
+	}
+	if name, ok := w.names[pkgPath]; ok {
+		switch name {
+		case ".":
+			return ""
+		case "":
+			return pkgName + "."
+		case "_":
+		default:
+			return name + "."
+		}
+	}
+	w.imports[pkgPath] = pkgName
+	w.names[pkgPath] = ""
+	return pkgName + "."
+}
+
+// isDefaultType returns true if t is the default type of untyped constant
+func isDefaultType(t reflect.Type) bool {
+	if t.PkgPath() != "" {
+		return false
+	}
+	switch t.Kind() {
+	case reflect.Bool, reflect.String, reflect.Int, reflect.Float64,
+		reflect.Complex128:
+		return true
+	}
+	return false
+}
+
+func isBasic(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Bool, reflect.String,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
+		reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64, reflect.Complex64, reflect.Complex128:
+		return true
+	}
+	return false
+}
+
+func isZero(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.String:
+		return v.Len() == 0
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
+		reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0 && !math.Signbit(v.Float())
+	case reflect.Complex64, reflect.Complex128:
+		return v.Complex() == 0
+	case reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if !isZero(v.Index(i)) {
+				return false
+			}
+		}
+		return true
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if !isZero(v.Field(i)) {
+				return false
+			}
+		}
+		return true
+	}
+	return isNil(v)
+}
+
+// importName returns name of the package imported by spec.
+// Returns "" for imports without explicit name
+func importName(spec *ast.ImportSpec) string {
+	if spec.Name != nil {
+		return spec.Name.Name
+	}
+	return ""
+}
+
+// importPath returns unquoted import path of spec
+func importPath(spec *ast.ImportSpec) string {
+	p, _ := strconv.Unquote(spec.Path.Value)
+	return p
+}
+
+// importSpec returns import spec source code for package
+func importSpec(pkgPath, pkgName string) string {
+	if path.Base(pkgPath) == pkgName {
+		return strconv.Quote(pkgPath)
+	}
+	return pkgName + " " + strconv.Quote(pkgPath)
+}
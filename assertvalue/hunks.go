@@ -0,0 +1,142 @@
+package assertvalue
+
+import (
+	"errors"
+	"fmt"
+	"github.com/pmezard/go-difflib/difflib"
+	"go/parser"
+	"strings"
+)
+
+const hunkHelp = `y - accept this hunk
+n - reject this hunk
+a - accept this and all remaining hunks
+d - reject this and all remaining hunks
+? - print help
+`
+
+// acceptHunks asks user to accept diff hunks one by one like
+// "git add -p". Returns new expected value which is the old one with
+// accepted hunks applied and false if all hunks are rejected
+func (p *keyPrompter) acceptHunks(m *Mismatch) (string, bool, error) {
+	expected, actual := m.Expected, m.Actual
+	isEqual := strings.TrimPrefix(m.Func, "Check") == "Equal"
+	if isEqual {
+		// Diff of Equal is made of formatted literals
+		expected, actual = formatLiteral(expected), formatLiteral(actual)
+	}
+	a, b := difflib.SplitLines(expected), difflib.SplitLines(actual)
+	groups := difflib.NewMatcher(a, b).GetGroupedOpCodes(3)
+
+	accepted := make([]bool, len(groups))
+	acceptedCount := 0
+	recurring := ""
+	for i, group := range groups {
+		answer := recurring
+		for answer == "" {
+			fmt.Print(formatHunk(a, b, group))
+			fmt.Printf("(%d/%d) Accept this hunk? [y,n,a,d,?] ", i+1, len(groups))
+			key, err := p.readKey()
+			if err != nil {
+				return "", false, err
+			}
+			fmt.Println(key)
+			switch key {
+			case "y", "n":
+				answer = key
+			case "a":
+				recurring, answer = "y", "y"
+			case "d":
+				recurring, answer = "n", "n"
+			default:
+				fmt.Print(hunkHelp)
+			}
+		}
+		if answer == "y" {
+			accepted[i] = true
+			acceptedCount++
+		}
+	}
+	if acceptedCount == 0 {
+		return "", false, nil
+	}
+	if acceptedCount == len(groups) {
+		return m.Actual, true, nil
+	}
+
+	merged := mergeHunks(a, b, groups, accepted)
+	if isEqual {
+		merged = strings.TrimSpace(merged)
+		if _, err := parser.ParseExpr(merged); err != nil {
+			return "", false, errors.New("Accepted hunks do not make a Go expression\n" +
+				err.Error())
+		}
+	}
+	return merged, true, nil
+}
+
+// mergeHunks applies accepted hunks of the diff of a and b to a
+func mergeHunks(a, b []string, groups [][]difflib.OpCode, accepted []bool) string {
+	var merged []string
+	i := 0
+	for n, group := range groups {
+		if !accepted[n] {
+			continue
+		}
+		for _, op := range group {
+			merged = append(merged, a[i:op.I1]...)
+			if op.Tag == 'e' {
+				merged = append(merged, a[op.I1:op.I2]...)
+			} else {
+				merged = append(merged, b[op.J1:op.J2]...)
+			}
+			i = op.I2
+		}
+	}
+	merged = append(merged, a[i:]...)
+	// difflib.SplitLines adds new line to the last line
+	return strings.TrimSuffix(strings.Join(merged, ""), "\n")
+}
+
+// formatHunk formats group of diff operations as unified diff hunk
+func formatHunk(a, b []string, group []difflib.OpCode) string {
+	var buf strings.Builder
+	first, last := group[0], group[len(group)-1]
+	fmt.Fprintf(&buf, "@@ -%s +%s @@\n",
+		formatRange(first.I1, last.I2), formatRange(first.J1, last.J2))
+	writeLines := func(prefix string, lines []string) {
+		for _, line := range lines {
+			buf.WriteString(prefix + line)
+			if !strings.HasSuffix(line, "\n") {
+				buf.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+	}
+	for _, op := range group {
+		if op.Tag == 'e' {
+			writeLines(" ", a[op.I1:op.I2])
+			continue
+		}
+		if op.Tag == 'r' || op.Tag == 'd' {
+			writeLines("-", a[op.I1:op.I2])
+		}
+		if op.Tag == 'r' || op.Tag == 'i' {
+			writeLines("+", b[op.J1:op.J2])
+		}
+	}
+	return buf.String()
+}
+
+// formatRange formats line range of unified diff hunk header
+// the same way as difflib does
+func formatRange(start, stop int) string {
+	beginning := start + 1
+	length := stop - start
+	if length == 1 {
+		return fmt.Sprintf("%d", beginning)
+	}
+	if length == 0 {
+		beginning--
+	}
+	return fmt.Sprintf("%d,%d", beginning, length)
+}
@@ -0,0 +1,257 @@
+package assertvalue
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Journal of edits inside module root. Every rewrite of test code or
+// golden file is recorded so it can be undone with "assertvalue undo"
+const journalFile = ".assertvalue/journal.jsonl"
+
+// Journal keeps edits of this number of the last test runs
+const journalRuns = 10
+
+// JournalEntry describes an edit of test code or golden file made when
+// a value was accepted
+type JournalEntry struct {
+	ID int `json:"id"`
+	// Test binary run which made the edit
+	Run  string    `json:"run"`
+	Time time.Time `json:"time"`
+	Test string    `json:"test"`
+	// Edited file relative to module root
+	File string `json:"file"`
+	// Byte range of the old text in the file before the edit. Texts are
+	// bytes since the range may split UTF-8 character or the file may be
+	// binary
+	Begin int    `json:"begin"`
+	End   int    `json:"end"`
+	Old   []byte `json:"old"`
+	New   []byte `json:"new"`
+	// File did not exist before the edit
+	Created bool `json:"created,omitempty"`
+}
+
+// ReadJournal returns edits journaled in the module containing dir
+// in the order they were made
+func ReadJournal(dir string) ([]*JournalEntry, error) {
+	root := moduleRoot(dir)
+	_, err := os.Stat(filepath.Join(root, filepath.FromSlash(journalFile)))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	var entries []*JournalEntry
+	err = updateJournal(root, func(all []*JournalEntry) ([]*JournalEntry, error) {
+		entries = all
+		return all, nil
+	})
+	return entries, err
+}
+
+// LastRun returns edits of the last test run
+func LastRun(entries []*JournalEntry) []*JournalEntry {
+	if len(entries) == 0 {
+		return nil
+	}
+	run := entries[len(entries)-1].Run
+	var last []*JournalEntry
+	for _, e := range entries {
+		if e.Run == run {
+			last = append(last, e)
+		}
+	}
+	return last
+}
+
+// Undo reverts edits of the module containing dir in reverse order and
+// removes them from the journal. Edits made later to the same files are
+// kept. Returns error if the edited text was changed since
+func Undo(dir string, edits []*JournalEntry) error {
+	root := moduleRoot(dir)
+	ids := make(map[int]bool)
+	for _, e := range edits {
+		ids[e.ID] = true
+	}
+	return updateJournal(root, func(all []*JournalEntry) ([]*JournalEntry, error) {
+		undone := make(map[int]bool)
+		var err error
+		for i := len(all) - 1; i >= 0; i-- {
+			e := all[i]
+			if !ids[e.ID] {
+				continue
+			}
+			err = undoEdit(root, e)
+			if err != nil {
+				break
+			}
+			undone[e.ID] = true
+			// Edits made after this one are shifted by its size
+			shift := len(e.Old) - len(e.New)
+			for _, later := range all[i+1:] {
+				if later.File == e.File && later.Begin >= e.Begin+len(e.New) {
+					later.Begin += shift
+					later.End += shift
+				}
+			}
+		}
+		// Remove reverted edits from the journal even if some failed
+		kept := all[:0]
+		for _, e := range all {
+			if !undone[e.ID] {
+				kept = append(kept, e)
+			}
+		}
+		return kept, err
+	})
+}
+
+// undoEdit replaces new text of the edit with the old one
+func undoEdit(root string, e *JournalEntry) error {
+	filename := filepath.Join(root, filepath.FromSlash(e.File))
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	begin := e.Begin
+	end := begin + len(e.New)
+	if end > len(content) || !bytes.Equal(content[begin:end], e.New) {
+		// Lines were added or removed above the edit. Look for the
+		// new text elsewhere if it is unambiguous
+		begin = bytes.Index(content, e.New)
+		if len(e.New) == 0 || begin < 0 || bytes.Count(content, e.New) != 1 {
+			return fmt.Errorf("Unable to undo edit %d of %s\n"+
+				"The file was changed since", e.ID, e.File)
+		}
+		end = begin + len(e.New)
+	}
+	var buf bytes.Buffer
+	buf.Write(content[:begin])
+	buf.Write(e.Old)
+	buf.Write(content[end:])
+	if e.Created && buf.Len() == 0 {
+		return os.Remove(filename)
+	}
+	return writeFileAtomic(filename, buf.Bytes())
+}
+
+// journalEdit records rewrite of file from old to new content made
+// by test. Caller must hold shared.mu
+func journalEdit(filename string, old, new []byte, created bool, test string) error {
+	begin, oldEnd, newEnd := changedRange(old, new)
+	root := moduleRoot(filepath.Dir(filename))
+	entry := &JournalEntry{
+		ID:      1,
+		Run:     shared.run,
+		Time:    time.Now(),
+		Test:    test,
+		File:    relSlashPath(root, filename),
+		Begin:   begin,
+		End:     oldEnd,
+		Old:     old[begin:oldEnd],
+		New:     new[begin:newEnd],
+		Created: created,
+	}
+	return updateJournal(root, func(all []*JournalEntry) ([]*JournalEntry, error) {
+		if len(all) > 0 {
+			entry.ID = all[len(all)-1].ID + 1
+		}
+		return pruneJournal(append(all, entry)), nil
+	})
+}
+
+// changedRange returns the range of old content which differs from the
+// new one: old[begin:oldEnd] is replaced by new[begin:newEnd]
+func changedRange(old, new []byte) (begin, oldEnd, newEnd int) {
+	for begin < len(old) && begin < len(new) && old[begin] == new[begin] {
+		begin++
+	}
+	oldEnd, newEnd = len(old), len(new)
+	for oldEnd > begin && newEnd > begin && old[oldEnd-1] == new[newEnd-1] {
+		oldEnd--
+		newEnd--
+	}
+	return begin, oldEnd, newEnd
+}
+
+// pruneJournal removes edits of all but the last journalRuns runs
+func pruneJournal(entries []*JournalEntry) []*JournalEntry {
+	runs := make(map[string]bool)
+	for i := len(entries) - 1; i >= 0; i-- {
+		runs[entries[i].Run] = true
+		if len(runs) > journalRuns {
+			return entries[i+1:]
+		}
+	}
+	return entries
+}
+
+// updateJournal reads journal of the module root, updates its entries
+// with update function and writes them back. Test binaries of several
+// packages may update the journal at once so it is locked meanwhile
+func updateJournal(root string, update func([]*JournalEntry) ([]*JournalEntry, error)) error {
+	filename := filepath.Join(root, filepath.FromSlash(journalFile))
+	err := os.MkdirAll(filepath.Dir(filename), 0755)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	err = lockFile(f)
+	if err != nil {
+		return err
+	}
+	defer unlockFile(f)
+	buf, err := ioutil.ReadAll(f)
+	if err != nil {
+		return err
+	}
+
+	var entries []*JournalEntry
+	for i, line := range strings.Split(string(buf), "\n") {
+		if line == "" {
+			continue
+		}
+		e := &JournalEntry{}
+		err = json.Unmarshal([]byte(line), e)
+		if err != nil {
+			return fmt.Errorf("Invalid journal entry %s:%d: %s", filename, i+1, err)
+		}
+		entries = append(entries, e)
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].ID < entries[j].ID
+	})
+
+	entries, updateErr := update(entries)
+	var out bytes.Buffer
+	for _, e := range entries {
+		line, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		out.Write(line)
+		out.WriteString("\n")
+	}
+	if !bytes.Equal(out.Bytes(), buf) {
+		err = f.Truncate(0)
+		if err != nil {
+			return err
+		}
+		_, err = f.WriteAt(out.Bytes(), 0)
+		if err != nil {
+			return err
+		}
+	}
+	return updateErr
+}
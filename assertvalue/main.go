@@ -0,0 +1,47 @@
+package assertvalue
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"testing"
+)
+
+// Main runs the tests and prints summary of missing expected values
+// found in strict mode and of files rewritten in git mode. Call it from
+// TestMain
+//
+//	func TestMain(m *testing.M) {
+//		assertvalue.Main(m)
+//	}
+func Main(m *testing.M) {
+	code := m.Run()
+	shared.mu.Lock()
+	defer shared.mu.Unlock()
+	if len(shared.missing) > 0 {
+		fmt.Printf("assertvalue: snapshots missing: %d\n", len(shared.missing))
+		for _, m := range shared.missing {
+			fmt.Printf("\t%s:%d %s", relPath(m.Source),
+				shared.currentLineNumber(m.Source, m.Line), m.Test)
+			if m.Golden != "" {
+				fmt.Printf(" (golden file %s)", relPath(m.Golden))
+			}
+			fmt.Println()
+		}
+		if code == 0 {
+			code = 1
+		}
+	}
+	if settings().git && len(shared.modified) > 0 {
+		fmt.Printf("assertvalue: files modified: %d\n", len(shared.modified))
+		filenames := make([]string, 0, len(shared.modified))
+		for filename := range shared.modified {
+			filenames = append(filenames, relPath(filename))
+		}
+		sort.Strings(filenames)
+		for _, filename := range filenames {
+			fmt.Println("\t" + filename)
+		}
+	}
+	os.Exit(code)
+}
@@ -0,0 +1,134 @@
+package assertvalue
+
+import (
+	"go/ast"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// Mismatch describes expected value which differs from actual value
+// and which can be updated from it
+type Mismatch struct {
+	// Assertion function: String, Value, Equal, File or their Check*
+	// variants
+	Func string `json:"func"`
+	// Test source file and line of the assertion call as reported
+	// by runtime.Caller
+	Source string `json:"source"`
+	Line   int    `json:"line"`
+	Test   string `json:"test"`
+	// Assertion is called as Session method
+	Method bool `json:"method,omitempty"`
+	// Golden file of assertvalue.File
+	Golden string `json:"golden,omitempty"`
+	// Old and new expected values. Heredoc content with markers for
+	// String and Value, Go literal for Equal, file content for File
+	Expected string `json:"expected"`
+	Actual   string `json:"actual"`
+	// Expected value does not exist yet: the call has no expected
+	// argument or golden file is missing
+	New bool `json:"new,omitempty"`
+	// Imports required by Go literal of assertvalue.Equal.
+	// Import path => package name
+	Imports map[string]string `json:"imports,omitempty"`
+	Diff    string            `json:"diff"`
+	// Pending record file the mismatch was read from
+	pendingFile string
+}
+
+// newMismatch creates mismatch for the assertion called skip frames
+// above newMismatch caller
+func (s *Session) newMismatch(fn string, skip int) *Mismatch {
+	pc, filename, lineNum, _ := runtime.Caller(skip + 2)
+	return &Mismatch{
+		Func:   fn,
+		Source: filename,
+		Line:   lineNum,
+		Test:   testName(s.t, pc),
+		Method: s.method,
+	}
+}
+
+// testName returns name of the test. testing.Benchmark runs benchmark
+// without name so name of the function calling the assertion is used
+func testName(t testing.TB, pc uintptr) string {
+	if name := t.Name(); name != "" {
+		return name
+	}
+	fn := runtime.FuncForPC(pc)
+	if fn == nil {
+		return ""
+	}
+	// Dots of the last path element are escaped in symbol names:
+	// example.com/foo%2ev2.BenchmarkFoo.func1
+	name := fn.Name()
+	parts := strings.Split(name[strings.LastIndex(name, "/")+1:], ".")
+	if len(parts) < 2 {
+		return ""
+	}
+	return parts[1]
+}
+
+// callSite returns location of the assertion call in the test code
+// as reported by runtime.Caller. File may be called in a loop with
+// different golden files so golden file is a part of the location
+func (m *Mismatch) callSite() string {
+	site := m.Source + ":" + strconv.Itoa(m.Line)
+	if m.Golden != "" {
+		site += ":" + m.Golden
+	}
+	return site
+}
+
+// Accept writes actual value as new expected value to the test code
+// or to the golden file. Removes pending record if mismatch was read
+// from one
+func (m *Mismatch) Accept() error {
+	shared.mu.Lock()
+	defer shared.mu.Unlock()
+	return m.accept()
+}
+
+// accept is Accept for callers holding shared.mu
+func (m *Mismatch) accept() error {
+	var err error
+	switch strings.TrimPrefix(m.Func, "Check") {
+	case "File":
+		err = writeGolden(m.Golden, []byte(m.Actual), m.Test)
+	case "Equal":
+		err = rewriteTestCode(m.Source, m.Line, m.Func, m.Method, m.Test, m.Imports,
+			func(c *testCode, call *ast.CallExpr) ([]byte, error) {
+				err := m.checkSource(c, call)
+				if err != nil {
+					return nil, err
+				}
+				if !hasExpected(call, m.Method) {
+					return createExpected(c, call, m.Actual)
+				}
+				return updateExpected(c, call, m.Actual)
+			})
+	default:
+		err = rewriteTestCode(m.Source, m.Line, m.Func, m.Method, m.Test, nil,
+			func(c *testCode, call *ast.CallExpr) ([]byte, error) {
+				err := m.checkSource(c, call)
+				if err != nil {
+					return nil, err
+				}
+				return updateText(c, call, m.Method, unmarkText(m.Actual), m.Test)
+			})
+	}
+	if err != nil {
+		return err
+	}
+	return m.Discard()
+}
+
+// Discard removes pending record if mismatch was read from one
+func (m *Mismatch) Discard() error {
+	if m.pendingFile == "" {
+		return nil
+	}
+	return removePending(m.pendingFile)
+}
@@ -0,0 +1,117 @@
+package assertvalue
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Directory inside module root where pending values are stored by default
+const defaultPendingDir = ".assertvalue/pending"
+
+// PendingDir returns default directory of pending values for the Go
+// module containing dir
+func PendingDir(dir string) string {
+	return filepath.Join(moduleRoot(dir), filepath.FromSlash(defaultPendingDir))
+}
+
+// moduleRoot returns the closest directory containing go.mod.
+// Returns dir itself if there is no go.mod
+func moduleRoot(dir string) string {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return dir
+	}
+	for d := dir; ; {
+		if _, err := os.Stat(filepath.Join(d, "go.mod")); err == nil {
+			return d
+		}
+		parent := filepath.Dir(d)
+		if parent == d {
+			return dir
+		}
+		d = parent
+	}
+}
+
+// savePending writes mismatch as pending record to dir. Record file
+// name depends only on the assertion so rerunning the test replaces
+// the record. Returns record file name
+func savePending(dir string, m *Mismatch) (string, error) {
+	root := moduleRoot(filepath.Dir(m.Source))
+	key := fmt.Sprintf("%s:%d:%s:%s",
+		relSlashPath(root, m.Source), m.Line, m.Test, relSlashPath(root, m.Golden))
+	hash := sha1.Sum([]byte(key))
+	filename := filepath.Join(dir, hex.EncodeToString(hash[:8])+".json")
+
+	buf, err := json.MarshalIndent(m, "", "\t")
+	if err != nil {
+		return "", err
+	}
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return "", err
+	}
+	return filename, ioutil.WriteFile(filename, buf, 0644)
+}
+
+// ReadPending reads pending records from dir sorted by test source
+// file and line
+func ReadPending(dir string) ([]*Mismatch, error) {
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var mismatches []*Mismatch
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		filename := filepath.Join(dir, file.Name())
+		buf, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		m := &Mismatch{pendingFile: filename}
+		err = json.Unmarshal(buf, m)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid pending record %s: %s", filename, err)
+		}
+		mismatches = append(mismatches, m)
+	}
+	sort.SliceStable(mismatches, func(i, j int) bool {
+		a, b := mismatches[i], mismatches[j]
+		if a.Source != b.Source {
+			return a.Source < b.Source
+		}
+		return a.Line < b.Line
+	})
+	return mismatches, nil
+}
+
+// relSlashPath returns slash separated path relative to root if possible
+func relSlashPath(root, path string) string {
+	if path == "" {
+		return ""
+	}
+	if rel, err := filepath.Rel(root, path); err == nil {
+		path = rel
+	}
+	return filepath.ToSlash(path)
+}
+
+func removePending(filename string) error {
+	err := os.Remove(filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,266 @@
+package assertvalue
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unsafe"
+)
+
+var (
+	errorType = reflect.TypeOf((*error)(nil)).Elem()
+	timeType  = reflect.TypeOf(time.Time{})
+)
+
+// Pretty printer renders arbitrary Go values into stable multiline text
+// suitable for heredoc expected values:
+//   - struct fields and slice elements are printed one per line
+//   - maps are printed with sorted keys
+//   - pointers are dereferenced, cycles through pointers, maps and
+//     slices are printed as <cycle>
+//   - time.Time and errors are printed as their text representation
+//   - unexported fields are printed too
+type prettyPrinter struct {
+	buf bytes.Buffer
+	// Pointers, maps and slices being printed at the moment. Used to
+	// detect cycles
+	visiting map[visit]bool
+}
+
+// Reference value being printed. Slice has the same address as its first
+// element so type and length are parts of the key too
+type visit struct {
+	ptr uintptr
+	typ reflect.Type
+	len int
+}
+
+func prettyPrint(value interface{}) string {
+	if value == nil {
+		return "nil\n"
+	}
+	// Copy value into addressable one so we can access unexported fields
+	v := reflect.ValueOf(value)
+	root := reflect.New(v.Type()).Elem()
+	root.Set(v)
+	p := &prettyPrinter{visiting: make(map[visit]bool)}
+	p.print(root, 0)
+	p.buf.WriteString("\n")
+	return p.buf.String()
+}
+
+func (p *prettyPrinter) print(v reflect.Value, depth int) {
+	if !v.IsValid() {
+		p.buf.WriteString("nil")
+		return
+	}
+	v = exported(v)
+	if v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			p.buf.WriteString("nil")
+		} else {
+			p.print(v.Elem(), depth)
+		}
+		return
+	}
+	if v.Type() == timeType && v.CanInterface() {
+		t := v.Interface().(time.Time)
+		p.buf.WriteString("time.Time(" + t.Format(time.RFC3339Nano) + ")")
+		return
+	}
+	if v.Type().Implements(errorType) && v.CanInterface() && !isNil(v) {
+		err := v.Interface().(error)
+		p.buf.WriteString(typeName(v.Type()) + "(" + strconv.Quote(err.Error()) + ")")
+		return
+	}
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Map, reflect.Slice:
+		if !v.IsNil() && (v.Kind() != reflect.Slice || v.Len() > 0) {
+			key := visit{v.Pointer(), v.Type(), 0}
+			if v.Kind() == reflect.Slice {
+				key.len = v.Len()
+			}
+			if p.visiting[key] {
+				p.buf.WriteString("<cycle>")
+				return
+			}
+			p.visiting[key] = true
+			defer delete(p.visiting, key)
+		}
+	}
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			p.buf.WriteString(typeName(v.Type()) + "(nil)")
+			return
+		}
+		p.buf.WriteString("&")
+		p.print(v.Elem(), depth)
+	case reflect.Struct:
+		p.buf.WriteString(typeName(v.Type()) + "{")
+		for i := 0; i < v.NumField(); i++ {
+			p.newline(depth + 1)
+			p.buf.WriteString(v.Type().Field(i).Name + ": ")
+			p.print(v.Field(i), depth+1)
+			p.buf.WriteString(",")
+		}
+		p.close(v.NumField(), depth)
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			p.buf.WriteString(typeName(v.Type()) + "(nil)")
+			return
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 && v.Kind() == reflect.Slice {
+			p.buf.WriteString(typeName(v.Type()) + "(" + strconv.Quote(string(v.Bytes())) + ")")
+			return
+		}
+		p.buf.WriteString(typeName(v.Type()) + "{")
+		for i := 0; i < v.Len(); i++ {
+			p.newline(depth + 1)
+			p.print(v.Index(i), depth+1)
+			p.buf.WriteString(",")
+		}
+		p.close(v.Len(), depth)
+	case reflect.Map:
+		if v.IsNil() {
+			p.buf.WriteString(typeName(v.Type()) + "(nil)")
+			return
+		}
+		p.buf.WriteString(typeName(v.Type()) + "{")
+		for _, key := range sortedKeys(v) {
+			p.newline(depth + 1)
+			p.print(key, depth+1)
+			p.buf.WriteString(": ")
+			p.print(v.MapIndex(key), depth+1)
+			p.buf.WriteString(",")
+		}
+		p.close(v.Len(), depth)
+	case reflect.String:
+		p.scalar(v, strconv.Quote(v.String()))
+	case reflect.Bool:
+		p.scalar(v, strconv.FormatBool(v.Bool()))
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		p.scalar(v, strconv.FormatInt(v.Int(), 10))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
+		reflect.Uint64, reflect.Uintptr:
+		p.scalar(v, strconv.FormatUint(v.Uint(), 10))
+	case reflect.Float32, reflect.Float64:
+		p.scalar(v, strconv.FormatFloat(v.Float(), 'g', -1, v.Type().Bits()))
+	case reflect.Complex64, reflect.Complex128:
+		p.scalar(v, fmt.Sprint(v.Complex()))
+	default:
+		// Channels, functions and unsafe pointers. Do not print addresses
+		// because they differ from run to run
+		if isNil(v) {
+			p.buf.WriteString(typeName(v.Type()) + "(nil)")
+		} else {
+			p.buf.WriteString(typeName(v.Type()) + "(...)")
+		}
+	}
+}
+
+// scalar prints basic value. Values of named types are printed as
+// type conversions, i.e. Color("red")
+func (p *prettyPrinter) scalar(v reflect.Value, s string) {
+	if v.Type().PkgPath() != "" {
+		s = typeName(v.Type()) + "(" + s + ")"
+	}
+	p.buf.WriteString(s)
+}
+
+func (p *prettyPrinter) newline(depth int) {
+	p.buf.WriteString("\n" + strings.Repeat("\t", depth))
+}
+
+// close prints closing brace of composite value with n elements
+func (p *prettyPrinter) close(n, depth int) {
+	if n > 0 {
+		p.newline(depth)
+	}
+	p.buf.WriteString("}")
+}
+
+// exported returns value which allows calling Interface() on unexported
+// struct fields. Map keys and values and interface elements are not
+// addressable so they are copied into addressable value first
+func exported(v reflect.Value) reflect.Value {
+	if !v.CanAddr() {
+		if !v.CanInterface() {
+			return v
+		}
+		addressable := reflect.New(v.Type()).Elem()
+		addressable.Set(v)
+		return addressable
+	}
+	if v.CanInterface() {
+		return v
+	}
+	return reflect.NewAt(v.Type(), unsafe.Pointer(v.UnsafeAddr())).Elem()
+}
+
+func isNil(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Chan, reflect.Func, reflect.Interface, reflect.Map,
+		reflect.Ptr, reflect.Slice, reflect.UnsafePointer:
+		return v.IsNil()
+	}
+	return false
+}
+
+// typeName returns type name usable in type conversion
+func typeName(t reflect.Type) string {
+	name := t.String()
+	if strings.HasPrefix(name, "*") || strings.HasPrefix(name, "func") ||
+		strings.HasPrefix(name, "chan") || strings.HasPrefix(name, "<-") {
+		return "(" + name + ")"
+	}
+	return name
+}
+
+// sortedKeys returns map keys in stable order. Numbers are sorted
+// numerically and everything else by printed representation
+func sortedKeys(v reflect.Value) []reflect.Value {
+	keys := v.MapKeys()
+	printed := make([]string, len(keys))
+	for i, key := range keys {
+		kp := &prettyPrinter{visiting: make(map[visit]bool)}
+		kp.print(key, 0)
+		printed[i] = kp.buf.String()
+	}
+	sort.Sort(&keySorter{keys, printed})
+	return keys
+}
+
+type keySorter struct {
+	keys    []reflect.Value
+	printed []string
+}
+
+func (s *keySorter) Len() int {
+	return len(s.keys)
+}
+
+func (s *keySorter) Swap(i, j int) {
+	s.keys[i], s.keys[j] = s.keys[j], s.keys[i]
+	s.printed[i], s.printed[j] = s.printed[j], s.printed[i]
+}
+
+func (s *keySorter) Less(i, j int) bool {
+	a, b := s.keys[i], s.keys[j]
+	if a.Kind() == b.Kind() {
+		switch a.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			return a.Int() < b.Int()
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
+			reflect.Uint64, reflect.Uintptr:
+			return a.Uint() < b.Uint()
+		case reflect.Float32, reflect.Float64:
+			return a.Float() < b.Float()
+		}
+	}
+	return s.printed[i] < s.printed[j]
+}
@@ -0,0 +1,221 @@
+package assertvalue
+
+import (
+	"errors"
+	"fmt"
+	"github.com/mattn/go-tty"
+	"go/parser"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+const promptHelp = `y - accept this value
+n - reject this value
+Y - accept this and all remaining values
+N - reject this and all remaining values
+a - accept this and all remaining values in this file
+r - reject this and all remaining values in this file
+s - reject this value and do not ask again for this assertion
+q - quit, reject this and all remaining values
+h - accept or reject the diff hunk by hunk
+e - edit this value in $VISUAL or $EDITOR and accept it
+d - show the diff again
+? - print help
+`
+
+// Prompter decides whether to accept new value of mismatch. Prompter
+// may change m.Actual to accept modified value, i.e. edited by user.
+// Such value is written as expected but the test fails because it
+// differs from actual one. Prompt is never called concurrently
+type Prompter interface {
+	Prompt(m *Mismatch) (bool, error)
+}
+
+// TTYPrompter returns default prompter which asks user to press a key
+// on the terminal
+func TTYPrompter() Prompter {
+	return &keyPrompter{}
+}
+
+// ScriptedPrompter returns prompter which answers with keys of answers
+// in order as if they were pressed by user, i.e. "yn?y". Prompt fails
+// when answers are over. Useful to test the tests
+func ScriptedPrompter(answers string) Prompter {
+	return &keyPrompter{scripted: true, script: strings.Split(answers, "")}
+}
+
+// keyPrompter asks to press single key for every answer
+type keyPrompter struct {
+	// Read keys from script instead of terminal
+	scripted bool
+	script   []string
+}
+
+func (p *keyPrompter) Prompt(m *Mismatch) (bool, error) {
+	for {
+		fmt.Print("Accept new value? [y,n,Y,N,a,r,s,q,h,e,d,?] ")
+		answer, err := p.readKey()
+		if err != nil {
+			fmt.Println()
+			return false, err
+		}
+		fmt.Println(answer)
+		switch answer {
+		case "y":
+			return true, nil
+		case "n":
+			return false, nil
+		case "Y":
+			shared.recurringAnswer = "y"
+			return true, nil
+		case "N", "q":
+			shared.recurringAnswer = "n"
+			return false, nil
+		case "a":
+			shared.fileAnswers[m.Source] = "y"
+			return true, nil
+		case "r":
+			shared.fileAnswers[m.Source] = "n"
+			return false, nil
+		case "s":
+			shared.skippedSites[m.callSite()] = true
+			return false, nil
+		case "h":
+			merged, ok, err := p.acceptHunks(m)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			if ok {
+				m.Actual = merged
+			}
+			return ok, nil
+		case "e":
+			edited, err := editValue(m)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+			m.Actual = edited
+			return true, nil
+		case "d":
+			fmt.Println(formatMismatch(m))
+		default:
+			fmt.Print(promptHelp)
+		}
+	}
+}
+
+// readKey returns next key of the script or reads single keystroke
+// from the terminal
+func (p *keyPrompter) readKey() (string, error) {
+	if p.scripted {
+		if len(p.script) == 0 {
+			return "", errors.New("No more scripted answers")
+		}
+		answer := p.script[0]
+		p.script = p.script[1:]
+		return answer, nil
+	}
+	// testing framework changes os.Stdin
+	// We need real interaction with user
+	tty, err := tty.Open()
+	if err != nil {
+		return "", err
+	}
+	defer tty.Close()
+	for {
+		r, err := tty.ReadRune()
+		if err != nil {
+			return "", err
+		}
+		switch r {
+		case '\r', '\n':
+			// Ignore Enter pressed out of habit after the answer
+			continue
+		case 4:
+			// Ctrl-D
+			return "q", nil
+		}
+		return string(r), nil
+	}
+}
+
+// recurringAnswer returns answer given to all remaining values of the
+// test binary or of the test file. Returns "" if there is none
+func recurringAnswer(m *Mismatch) string {
+	if shared.recurringAnswer != "" {
+		return shared.recurringAnswer
+	}
+	return shared.fileAnswers[m.Source]
+}
+
+// editValue opens proposed expected value in $VISUAL or $EDITOR and
+// returns edited value
+func editValue(m *Mismatch) (string, error) {
+	editor := os.Getenv("VISUAL")
+	if editor == "" {
+		editor = os.Getenv("EDITOR")
+	}
+	if editor == "" {
+		editor = "vi"
+	}
+	// Let editor recognize the content
+	ext := ".txt"
+	switch strings.TrimPrefix(m.Func, "Check") {
+	case "Equal":
+		ext = ".go"
+	case "File":
+		if e := filepath.Ext(m.Golden); e != "" {
+			ext = e
+		}
+	}
+	f, err := ioutil.TempFile("", "assertvalue-*"+ext)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(m.Actual)
+	f.Close()
+	if err != nil {
+		return "", err
+	}
+
+	args := strings.Fields(editor)
+	cmd := exec.Command(args[0], append(args[1:], f.Name())...)
+	// testing framework changes os.Stdin. Run editor on the terminal
+	// if there is one
+	if tty, err := tty.Open(); err == nil {
+		defer tty.Close()
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = tty.Input(), tty.Output(), tty.Output()
+	} else {
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	}
+	err = cmd.Run()
+	if err != nil {
+		return "", errors.New("Unable to run editor\n" + err.Error())
+	}
+	buf, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		return "", err
+	}
+	edited := string(buf)
+	switch strings.TrimPrefix(m.Func, "Check") {
+	case "File":
+		// Golden file content is used as is
+	case "Equal":
+		edited = strings.TrimSpace(edited)
+		if _, err := parser.ParseExpr(edited); err != nil {
+			return "", errors.New("Edited value is not a Go expression\n" + err.Error())
+		}
+	default:
+		// Heredoc always ends with new line
+		if !strings.HasSuffix(edited, "\n") {
+			edited += "\n"
+		}
+	}
+	return edited, nil
+}
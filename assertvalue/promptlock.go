@@ -0,0 +1,42 @@
+package assertvalue
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// Lock file inside module root. "go test ./..." runs test binaries of
+// several packages at once. Only the binary holding the lock may prompt
+// user so prompts do not collide on the terminal
+const promptLockFile = ".assertvalue/prompt.lock"
+
+// lockPrompt acquires prompt lock of the module containing source file.
+// Waits while another test binary holds the lock unless wait is false,
+// waiting is called before that. Returns nil unlock function if the lock
+// is busy and wait is false
+func lockPrompt(source string, wait bool, waiting func()) (unlock func(), err error) {
+	filename := filepath.Join(moduleRoot(filepath.Dir(source)),
+		filepath.FromSlash(promptLockFile))
+	err = os.MkdirAll(filepath.Dir(filename), 0755)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	locked, err := tryLockFile(f)
+	if err == nil && !locked && wait {
+		waiting()
+		err = lockFile(f)
+		locked = err == nil
+	}
+	if err != nil || !locked {
+		f.Close()
+		return nil, err
+	}
+	return func() {
+		unlockFile(f)
+		f.Close()
+	}, nil
+}
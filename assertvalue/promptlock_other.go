@@ -0,0 +1,21 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package assertvalue
+
+import "os"
+
+// File locking is not implemented on this platform. Prompts of test
+// binaries running at once are not coordinated
+
+func tryLockFile(f *os.File) (bool, error) {
+	return true, nil
+}
+
+func lockFile(f *os.File) error {
+	return nil
+}
+
+func unlockFile(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,58 @@
+package assertvalue
+
+import (
+	"fmt"
+	"io"
+)
+
+// Reporter renders mismatches and what happened to them. Reporter
+// methods are never called concurrently
+type Reporter interface {
+	// Mismatch is called before new value is accepted or rejected
+	Mismatch(m *Mismatch)
+	// Accepted is called after new value is written
+	Accepted(m *Mismatch)
+	// Rejected is called when new value is rejected or saved as pending
+	Rejected(m *Mismatch)
+	// Pending is called after mismatch is saved as pending record
+	Pending(m *Mismatch, filename string)
+	// Waiting is called before waiting while test binary of another
+	// package prompts user
+	Waiting(m *Mismatch)
+}
+
+// TextReporter returns default reporter which writes diffs labelled with
+// the assertion location to w
+func TextReporter(w io.Writer) Reporter {
+	return &textReporter{w}
+}
+
+type textReporter struct {
+	w io.Writer
+}
+
+func (r *textReporter) Mismatch(m *Mismatch) {
+	fmt.Fprintln(r.w, formatMismatch(m))
+}
+
+func (r *textReporter) Accepted(m *Mismatch) {
+}
+
+func (r *textReporter) Rejected(m *Mismatch) {
+}
+
+func (r *textReporter) Pending(m *Mismatch, filename string) {
+	fmt.Fprintln(r.w, "Saved pending value to "+relPath(filename))
+}
+
+func (r *textReporter) Waiting(m *Mismatch) {
+	fmt.Fprintln(r.w, "Waiting for another test binary to finish prompting...")
+}
+
+// formatMismatch returns the diff labelled with the assertion location.
+// Earlier accepted values may have moved the assertion in the test code.
+// Caller must hold shared.mu
+func formatMismatch(m *Mismatch) string {
+	return fmt.Sprintf("--- %s:%d %s\n%s", relPath(m.Source),
+		shared.currentLineNumber(m.Source, m.Line), m.Test, m.Diff)
+}
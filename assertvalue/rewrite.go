@@ -0,0 +1,580 @@
+package assertvalue
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/MakeNowJust/heredoc"
+	"go/ast"
+	"go/build"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Import path of this package. It may be imported with any name
+var assertvaluePath = reflect.TypeOf(Session{}).PkgPath()
+
+// Functions removing heredoc indentation which may wrap expected value
+// of String and Value. Import path => function name
+var docFuncs = map[string]string{
+	"github.com/MakeNowJust/heredoc":     "Doc",
+	"github.com/MakeNowJust/heredoc/dot": "D",
+}
+
+// Package names of imports which differ from the last element of path
+var pkgNames = map[string]string{
+	"github.com/MakeNowJust/heredoc/dot": "heredoc_dot",
+}
+
+// Source code of a test file parsed for rewriting
+type testCode struct {
+	filename string
+	src      []byte
+	fset     *token.FileSet
+	file     *ast.File
+}
+
+func parseTestCode(filename string, src []byte) (*testCode, error) {
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, filename, src, parser.ParseComments)
+	if err != nil {
+		return nil, errors.New("Unable to parse test code\n" + err.Error())
+	}
+	return &testCode{filename, src, fset, file}, nil
+}
+
+// findCall returns assertvalue.<name>() call expression or <name>() method
+// call of a session if method is true located at lineNum. The package may
+// be imported with other name or with dot.
+//
+// runtime.Caller reports the line where the call begins, but gofmt allows
+// to split selector expression so accept any line between the beginning
+// of the call and its opening parenthesis.
+//
+// Method calls of other types with the same name may be at the line too,
+// i.e. sb.String() before the assertion or inside of its arguments. The
+// last call at the line which is not an argument of another one is taken
+func (c *testCode) findCall(lineNum int, name string, method bool) (*ast.CallExpr, error) {
+	var found *ast.CallExpr
+	pkg := c.pkgName(assertvaluePath)
+	ast.Inspect(c.file, func(n ast.Node) bool {
+		call, ok := n.(*ast.CallExpr)
+		if !ok || !isAssertvalueCall(call, pkg, name, method) {
+			return true
+		}
+		begin := c.fset.Position(call.Pos()).Line
+		lparen := c.fset.Position(call.Lparen).Line
+		if begin <= lineNum && lineNum <= lparen &&
+			(found == nil || call.Pos() >= found.End()) {
+			found = call
+		}
+		return true
+	})
+	if found == nil {
+		what := "assertvalue." + name
+		if method {
+			what = "method " + name
+		}
+		return nil, fmt.Errorf("Unable to find %s call at %s:%d",
+			what, relPath(c.filename), lineNum)
+	}
+	return found, nil
+}
+
+// isAssertvalueCall returns true if call is a call of function name of
+// the package imported as pkg or a method call if method is true
+func isAssertvalueCall(call *ast.CallExpr, pkg, name string, method bool) bool {
+	if ident, ok := call.Fun.(*ast.Ident); ok {
+		return !method && pkg == "." && ident.Name == name
+	}
+	sel, ok := call.Fun.(*ast.SelectorExpr)
+	if !ok || sel.Sel.Name != name {
+		return false
+	}
+	x, ok := sel.X.(*ast.Ident)
+	isPkg := ok && x.Name == pkg
+	if method {
+		// Session may be stored in variable of any name or even be
+		// created in place: assertvalue.New(t).String(...). Assertion
+		// methods have at least actual value argument
+		return !isPkg && len(call.Args) > 0
+	}
+	return isPkg
+}
+
+// funcName returns name of called function or method
+func funcName(call *ast.CallExpr) string {
+	switch fun := call.Fun.(type) {
+	case *ast.Ident:
+		return fun.Name
+	case *ast.SelectorExpr:
+		return fun.Sel.Name
+	}
+	return ""
+}
+
+// pkgName returns name the package is referred by in the test code:
+// "." for dot import and "" if the package is not imported
+func (c *testCode) pkgName(pkgPath string) string {
+	for _, spec := range c.file.Imports {
+		if importPath(spec) != pkgPath {
+			continue
+		}
+		if name := importName(spec); name != "" {
+			return name
+		}
+		if name, ok := pkgNames[pkgPath]; ok {
+			return name
+		}
+		return path.Base(pkgPath)
+	}
+	return ""
+}
+
+// unwrapDoc returns argument of heredoc.Doc or D call wrapping expected
+// value and false if expr is not such call
+func (c *testCode) unwrapDoc(expr ast.Expr) (ast.Expr, bool) {
+	call, ok := expr.(*ast.CallExpr)
+	if !ok || len(call.Args) != 1 {
+		return nil, false
+	}
+	for pkgPath, name := range docFuncs {
+		pkg := c.pkgName(pkgPath)
+		if pkg != "" && isAssertvalueCall(call, pkg, name, false) {
+			return call.Args[0], true
+		}
+	}
+	return nil, false
+}
+
+// indent returns leading whitespace of the line where node begins
+func (c *testCode) indent(node ast.Node) string {
+	pos := c.fset.Position(node.Pos())
+	line := string(c.src[pos.Offset-pos.Column+1 : pos.Offset])
+	return line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+}
+
+func (c *testCode) offset(pos token.Pos) int {
+	return c.fset.Position(pos).Offset
+}
+
+// splice replaces src[begin:end] with s and formats resulting code
+func (c *testCode) splice(begin, end int, s string) ([]byte, error) {
+	var code []byte
+	code = append(code, c.src[:begin]...)
+	code = append(code, s...)
+	code = append(code, c.src[end:]...)
+	formatted, err := format.Source(code)
+	if err != nil {
+		return nil, errors.New("Unable to format test code\n" + err.Error())
+	}
+	return formatted, nil
+}
+
+// hasExpected returns true if the call has expected argument.
+// All assertvalue functions have two arguments before expected.
+// Session methods do not have t argument
+func hasExpected(call *ast.CallExpr, method bool) bool {
+	if method {
+		return len(call.Args) > 1
+	}
+	return len(call.Args) > 2
+}
+
+// createExpected adds expected argument to the call without one
+func createExpected(c *testCode, call *ast.CallExpr, expected string) ([]byte, error) {
+	last := call.Args[len(call.Args)-1]
+	return c.splice(c.offset(last.End()), c.offset(last.End()), ", "+expected)
+}
+
+// encodeExpected formats expected literal written to the test code.
+// Integration tests replace it with broken encoding to check that
+// written values are verified
+var encodeExpected = formatExpected
+
+// updateText writes expected literal of value as expected argument of
+// String or Value call and verifies the result. Literal of constant or
+// variable passed as expected argument is written to its declaration.
+// Returns test code of the call which is not changed if the declaration
+// is in another file of the package
+func updateText(c *testCode, call *ast.CallExpr, method bool, value, test string) ([]byte, error) {
+	if !hasExpected(call, method) {
+		code, err := createExpected(c, call, encodeExpected(value, c.indent(call)))
+		if err != nil {
+			return nil, err
+		}
+		return code, verifyExpected(c, call, code, method, value)
+	}
+	decl, expr, err := c.expectedLiteral(call)
+	if err != nil {
+		return nil, err
+	}
+	arg := call.Args[len(call.Args)-1]
+	if decl == c {
+		indent := c.indent(call)
+		if expr != arg {
+			indent = c.indent(expr)
+		}
+		return updateLiteral(c, expr, indent, value, func(code []byte) error {
+			return verifyExpected(c, call, code, method, value)
+		})
+	}
+	name := unparen(arg).(*ast.Ident).Name
+	code, err := updateLiteral(decl, expr, decl.indent(expr), value, func(code []byte) error {
+		return verifyDecl(decl, name, code, value)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(code, decl.src) {
+		// Constant shared with another call is already updated
+		return c.src, nil
+	}
+	err = writeTestCode(decl.filename, code, test)
+	if err != nil {
+		return nil, err
+	}
+	line := decl.fset.Position(expr.Pos()).Line
+	shared.updateLineNumbers(decl.filename, shared.originalLineNumber(decl.filename, line),
+		lineCount(code)-lineCount(decl.src))
+	return c.src, nil
+}
+
+// updateLiteral replaces expected literal expr with literal of value and
+// verifies the result. heredoc.Doc wrapping the literal is kept if
+// possible. Indent is indentation of the statement or declaration
+func updateLiteral(c *testCode, expr ast.Expr, indent, value string,
+	verify func(code []byte) error) ([]byte, error) {
+	expected := encodeExpected(value, indent)
+	if arg, ok := c.unwrapDoc(expr); ok {
+		code, err := c.splice(c.offset(arg.Pos()), c.offset(arg.End()), expected)
+		if err == nil && verify(code) == nil {
+			return code, nil
+		}
+		// Markers can't be used inside of the wrapper. Replace it
+	}
+	code, err := c.splice(c.offset(expr.Pos()), c.offset(expr.End()), expected)
+	if err != nil {
+		return nil, err
+	}
+	return code, verify(code)
+}
+
+// updateExpected replaces existing expected argument of the call
+func updateExpected(c *testCode, call *ast.CallExpr, expected string) ([]byte, error) {
+	arg := call.Args[len(call.Args)-1]
+	return c.splice(c.offset(arg.Pos()), c.offset(arg.End()), expected)
+}
+
+// expectedLiteral returns string literal or concatenation of them
+// optionally wrapped with heredoc.Doc which is expected argument of the
+// call and test code containing it. Constant or variable identifier is
+// resolved to the literal it is initialized with. It may be declared in
+// another file of the package
+func (c *testCode) expectedLiteral(call *ast.CallExpr) (*testCode, ast.Expr, error) {
+	arg := call.Args[len(call.Args)-1]
+	decl, expr := c, arg
+	if ident, ok := unparen(arg).(*ast.Ident); ok {
+		var err error
+		decl, expr, err = c.findDecl(ident)
+		if err != nil {
+			return nil, nil, err
+		}
+		if expr == nil {
+			pos := c.fset.Position(arg.Pos())
+			return nil, nil, fmt.Errorf("Unable to find declaration of %s used at %s:%d\n"+
+				"Expected value must be a string literal or a constant or variable "+
+				"of test code initialized with one", ident.Name, relPath(c.filename), pos.Line)
+		}
+	}
+	if _, ok := decl.expectedValue(expr); !ok {
+		pos := decl.fset.Position(expr.Pos())
+		return nil, nil, fmt.Errorf("Unable to parse expected from %s:%d\n"+
+			"Expected value must be a string literal", relPath(decl.filename), pos.Line)
+	}
+	return decl, expr, nil
+}
+
+// findDecl returns initial value of constant or variable and test code
+// of the file it is declared in. Returns nil expression if the
+// declaration is not found. Only test files are searched so production
+// code is never rewritten
+func (c *testCode) findDecl(ident *ast.Ident) (*testCode, ast.Expr, error) {
+	if ident.Obj != nil {
+		return c, declValue(ident.Obj, ident.Name), nil
+	}
+	// Identifier is not declared in the file. Look for package level
+	// declaration in other test files of the package
+	dir := filepath.Dir(c.filename)
+	filenames, err := filepath.Glob(filepath.Join(dir, "*_test.go"))
+	if err != nil {
+		return nil, nil, err
+	}
+	var found *testCode
+	var value ast.Expr
+	for _, filename := range filenames {
+		if filename == c.filename {
+			continue
+		}
+		// Skip files excluded by build constraints or GOOS/GOARCH suffix
+		match, err := build.Default.MatchFile(dir, filepath.Base(filename))
+		if err != nil {
+			return nil, nil, err
+		}
+		if !match {
+			continue
+		}
+		src, err := readTestCode(filename)
+		if err != nil {
+			return nil, nil, err
+		}
+		code, err := parseTestCode(filename, src)
+		if err != nil || code.file.Name.Name != c.file.Name.Name {
+			continue
+		}
+		obj := code.file.Scope.Lookup(ident.Name)
+		if obj == nil {
+			continue
+		}
+		if found != nil {
+			return nil, nil, fmt.Errorf("%s is declared in both %s and %s",
+				ident.Name, relPath(found.filename), relPath(filename))
+		}
+		found, value = code, declValue(obj, ident.Name)
+	}
+	return found, value, nil
+}
+
+// declValue returns initial value of constant or variable declared
+// with "const" or "var" and nil for other objects
+func declValue(obj *ast.Object, name string) ast.Expr {
+	spec, ok := obj.Decl.(*ast.ValueSpec)
+	if !ok || len(spec.Values) != len(spec.Names) {
+		return nil
+	}
+	for i, ident := range spec.Names {
+		if ident.Name == name {
+			return spec.Values[i]
+		}
+	}
+	return nil
+}
+
+func unparen(expr ast.Expr) ast.Expr {
+	if paren, ok := expr.(*ast.ParenExpr); ok {
+		return unparen(paren.X)
+	}
+	return expr
+}
+
+// expectedValue returns value of expected argument of String or Value
+// as the assertion compares it with actual value
+func (c *testCode) expectedValue(expr ast.Expr) (string, bool) {
+	if arg, ok := c.unwrapDoc(expr); ok {
+		value, ok := stringValue(arg)
+		return decodeExpected(heredoc.Doc(value), true), ok
+	}
+	value, ok := stringValue(expr)
+	return decodeExpected(value, false), ok
+}
+
+// stringValue returns value of string literal or concatenation of them
+func stringValue(expr ast.Expr) (string, bool) {
+	switch e := expr.(type) {
+	case *ast.BasicLit:
+		if e.Kind != token.STRING {
+			return "", false
+		}
+		s, err := strconv.Unquote(e.Value)
+		if err != nil {
+			return "", false
+		}
+		// Go removes carriage returns from raw strings
+		if e.Value[0] == '`' {
+			s = strings.Replace(s, "\r", "", -1)
+		}
+		return s, true
+	case *ast.BinaryExpr:
+		x, ok := stringValue(e.X)
+		if !ok || e.Op != token.ADD {
+			return "", false
+		}
+		y, ok := stringValue(e.Y)
+		return x + y, ok
+	case *ast.ParenExpr:
+		return stringValue(e.X)
+	}
+	return "", false
+}
+
+// verifyExpected parses rewritten test code and returns error if
+// expected argument of the call does not decode to value exactly as
+// String and Value do. The call must begin at the same line unless
+// declaration of expected value above the call was rewritten
+func verifyExpected(c *testCode, call *ast.CallExpr, code []byte,
+	method bool, value string) error {
+	line := c.fset.Position(call.Pos()).Line
+	if begin, _, _ := changedRange(c.src, code); begin < c.offset(call.Pos()) {
+		line += lineCount(code) - lineCount(c.src)
+	}
+	newCode, err := parseTestCode(c.filename, code)
+	if err == nil {
+		call, err = newCode.findCall(line, funcName(call), method)
+	}
+	if err != nil {
+		return err
+	}
+	decl, expr, err := newCode.expectedLiteral(call)
+	if err != nil {
+		return &verifyError{c.filename, line}
+	}
+	expected, _ := decl.expectedValue(expr)
+	if expected != value {
+		return &verifyError{decl.filename, decl.fset.Position(expr.Pos()).Line}
+	}
+	return nil
+}
+
+// verifyDecl parses rewritten code of the file declaring constant or
+// variable name and returns error if its initial value does not decode
+// to value
+func verifyDecl(c *testCode, name string, code []byte, value string) error {
+	newCode, err := parseTestCode(c.filename, code)
+	if err != nil {
+		return err
+	}
+	var expr ast.Expr
+	if obj := newCode.file.Scope.Lookup(name); obj != nil {
+		expr = declValue(obj, name)
+	}
+	if expr == nil {
+		return fmt.Errorf("Unable to find declaration of %s in %s", name, relPath(c.filename))
+	}
+	expected, ok := newCode.expectedValue(expr)
+	if !ok || expected != value {
+		return &verifyError{c.filename, newCode.fset.Position(expr.Pos()).Line}
+	}
+	return nil
+}
+
+// verifyError is returned when written expected value does not decode
+// to the accepted one
+type verifyError struct {
+	filename string
+	line     int
+}
+
+func (e *verifyError) Error() string {
+	return fmt.Sprintf("Refusing to rewrite %s:%d\n"+
+		"Written expected value does not decode to the accepted value",
+		relPath(e.filename), e.line)
+}
+
+// importNames returns imports of the test file.
+// Import path => import name ("" if imported without explicit name)
+func (c *testCode) importNames() map[string]string {
+	names := make(map[string]string)
+	for _, spec := range c.file.Imports {
+		names[importPath(spec)] = importName(spec)
+	}
+	return names
+}
+
+// addImports adds missing imports to the test code. imports is
+// import path => package name
+func addImports(filename string, src []byte, imports map[string]string) ([]byte, error) {
+	c, err := parseTestCode(filename, src)
+	if err != nil {
+		return nil, err
+	}
+	existing := c.importNames()
+	var specs []string
+	for pkgPath, pkgName := range imports {
+		if _, ok := existing[pkgPath]; !ok {
+			specs = append(specs, importSpec(pkgPath, pkgName))
+		}
+	}
+	if len(specs) == 0 {
+		return src, nil
+	}
+	sort.Strings(specs)
+	for _, decl := range c.file.Decls {
+		gen, ok := decl.(*ast.GenDecl)
+		if !ok || gen.Tok != token.IMPORT {
+			continue
+		}
+		if gen.Lparen.IsValid() {
+			// gofmt will sort imports
+			at := c.offset(gen.Lparen) + 1
+			return c.splice(at, at, "\n"+strings.Join(specs, "\n"))
+		}
+		// Single import without parenthesis
+		spec := string(c.src[c.offset(gen.Specs[0].Pos()):c.offset(gen.End())])
+		specs = append(specs, spec)
+		return c.splice(c.offset(gen.Pos()), c.offset(gen.End()),
+			"import (\n"+strings.Join(specs, "\n")+"\n)")
+	}
+	at := c.offset(c.file.Name.End())
+	return c.splice(at, at, "\n\nimport (\n"+strings.Join(specs, "\n")+"\n)")
+}
+
+// rewriteTestCode finds call to assertvalue.<name> (or method <name>)
+// which runtime.Caller reported at lineNum of filename, rewrites test
+// code of test with rewrite function and adds imports (import path =>
+// package name). Caller must hold shared.mu
+func rewriteTestCode(filename string, lineNum int, name string, method bool, test string,
+	imports map[string]string, rewrite func(c *testCode, call *ast.CallExpr) ([]byte, error)) error {
+	lineNum = shared.currentLineNumber(filename, lineNum)
+	err := checkStale(filename, lineNum)
+	if err != nil {
+		return err
+	}
+	src, err := readTestCode(filename)
+	if err != nil {
+		return err
+	}
+	code, err := parseTestCode(filename, src)
+	if err != nil {
+		return err
+	}
+	call, err := code.findCall(lineNum, name, method)
+	if err != nil {
+		return explainStale(filename, err)
+	}
+	newCode, err := rewrite(code, call)
+	if err != nil {
+		return err
+	}
+	withImports, err := addImports(filename, newCode, imports)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(withImports, code.src) {
+		// Declaration in another file was rewritten or the value is
+		// already written
+		return nil
+	}
+	err = writeTestCode(filename, withImports, test)
+	if err != nil {
+		return err
+	}
+	// Lines below the first changed one are shifted. It is not the line
+	// of the call if declaration of expected value was rewritten
+	begin, _, _ := changedRange(code.src, newCode)
+	changedLine := shared.originalLineNumber(filename, lineCount(code.src[:begin])+1)
+	shared.updateLineNumbers(filename, changedLine, lineCount(newCode)-lineCount(code.src))
+	// Imports shift all lines of the file
+	shared.updateLineNumbers(filename, 0, lineCount(withImports)-lineCount(newCode))
+	return nil
+}
+
+func lineCount(code []byte) int {
+	return bytes.Count(code, []byte("\n"))
+}
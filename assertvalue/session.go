@@ -0,0 +1,266 @@
+package assertvalue
+
+import (
+	"crypto/sha1"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Session binds assertions to a test. Functions of the package create
+// session implicitly. Create it explicitly to call assertions as methods
+//
+//	av := assertvalue.New(t)
+//	av.String(actual, `
+//		expected
+//	`)
+//
+// All sessions of the test binary share answers and changes of the test
+// code. Shared state is guarded by mutex so sessions are
+// safe to use in parallel tests and subtests
+type Session struct {
+	t testing.TB
+	// Assertions are called as methods. Expected argument position
+	// in the test code depends on it
+	method bool
+	// Session's own prompter and reporter. Shared ones are used if nil
+	prompter Prompter
+	reporter Reporter
+}
+
+// Option configures session
+type Option func(s *Session)
+
+// WithPrompter sets prompter of the session
+func WithPrompter(p Prompter) Option {
+	return func(s *Session) {
+		s.prompter = p
+	}
+}
+
+// WithReporter sets reporter of the session
+func WithReporter(r Reporter) Option {
+	return func(s *Session) {
+		s.reporter = r
+	}
+}
+
+// New returns session of the test
+func New(t testing.TB, options ...Option) *Session {
+	s := &Session{t: t, method: true}
+	for _, option := range options {
+		option(s)
+	}
+	return s
+}
+
+// SetPrompter sets prompter of all sessions without own prompter
+// and of package functions. TTYPrompter is used by default or
+// ScriptedPrompter if prompts are given with -assertvalue.prompts
+func SetPrompter(p Prompter) {
+	shared.mu.Lock()
+	defer shared.mu.Unlock()
+	shared.prompter = p
+}
+
+// SetReporter sets reporter of all sessions without own reporter
+// and of package functions. TextReporter writing to os.Stdout is used
+// by default
+func SetReporter(r Reporter) {
+	shared.mu.Lock()
+	defer shared.mu.Unlock()
+	shared.reporter = r
+}
+
+// Caller must hold shared.mu
+func (s *Session) getPrompter() Prompter {
+	if s.prompter != nil {
+		return s.prompter
+	}
+	if shared.prompter == nil {
+		if prompts := settings().prompts; prompts != "" {
+			shared.prompter = ScriptedPrompter(prompts)
+		} else {
+			shared.prompter = TTYPrompter()
+		}
+	}
+	return shared.prompter
+}
+
+// Caller must hold shared.mu
+func (s *Session) getReporter() Reporter {
+	if s.reporter != nil {
+		return s.reporter
+	}
+	return shared.reporter
+}
+
+// newSession returns implicit session of package functions
+func newSession(t testing.TB) *Session {
+	return &Session{t: t}
+}
+
+// File is like assertvalue.File
+func (s *Session) File(actual, filename string) {
+	s.t.Helper()
+	s.checkFile("File", actual, filename)
+}
+
+// CheckFile is like assertvalue.CheckFile
+func (s *Session) CheckFile(actual, filename string) bool {
+	s.t.Helper()
+	return s.checkFile("CheckFile", actual, filename)
+}
+
+// String is like assertvalue.String
+func (s *Session) String(args ...string) {
+	s.t.Helper()
+	checkStringArgs(s.t, args)
+	s.assertString("String", args[0], args[1:])
+}
+
+// CheckString is like assertvalue.CheckString
+func (s *Session) CheckString(args ...string) bool {
+	s.t.Helper()
+	checkStringArgs(s.t, args)
+	return s.assertString("CheckString", args[0], args[1:])
+}
+
+// Value is like assertvalue.Value
+func (s *Session) Value(actual interface{}, expected ...string) {
+	s.t.Helper()
+	checkValueArgs(s.t, expected)
+	s.assertString("Value", prettyPrint(actual), expected)
+}
+
+// CheckValue is like assertvalue.CheckValue
+func (s *Session) CheckValue(actual interface{}, expected ...string) bool {
+	s.t.Helper()
+	checkValueArgs(s.t, expected)
+	return s.assertString("CheckValue", prettyPrint(actual), expected)
+}
+
+// Equal is like assertvalue.Equal
+func (s *Session) Equal(actual interface{}, expected ...interface{}) {
+	s.t.Helper()
+	s.checkEqual("Equal", actual, expected)
+}
+
+// CheckEqual is like assertvalue.CheckEqual
+func (s *Session) CheckEqual(actual interface{}, expected ...interface{}) bool {
+	s.t.Helper()
+	return s.checkEqual("CheckEqual", actual, expected)
+}
+
+// State of the test binary shared by all sessions.
+// All access must be guarded by mu
+type state struct {
+	mu sync.Mutex
+	// Default prompter and reporter. Prompter is created on first use
+	// because flags are not parsed yet on initialization
+	prompter Prompter
+	reporter Reporter
+	// Terminal is available for TTYPrompter. Checked on first use
+	hasTerminal *bool
+	// Answer to all remaining prompts: "y" or "n"
+	recurringAnswer string
+	// Answers to all remaining prompts of the test file by file name
+	fileAnswers map[string]string
+	// Assertion call sites user asked not to prompt for again
+	skippedSites map[string]bool
+	// Files written in dry-run mode. File name => content
+	written map[string][]byte
+	// Files rewritten during the test run
+	modified map[string]bool
+	// Test run identifier of journal entries
+	run string
+	// Hash of test files when they were seen first by file name
+	sources map[string][sha1.Size]byte
+	// Missing expected values found in strict mode
+	missing []*Mismatch
+	// Keep tracking of changes in test code
+	// Changing expected may change the number of lines in test code
+	// and runtime.Caller returns initial file line numbers
+	// We keep line number changes here in the form of offsets
+	// fileChanges[filename][line] => offset
+	fileChanges map[string]map[int]int
+	// Values accepted during the test run by assertion call site.
+	// Loops and benchmarks call the same assertion many times but
+	// compiled code still has the old expected value. Do not ask
+	// to accept the same value again
+	// acceptedValues[filename:line] => value
+	acceptedValues map[string]string
+}
+
+func newState() *state {
+	return &state{
+		reporter:       TextReporter(os.Stdout),
+		fileAnswers:    make(map[string]string),
+		skippedSites:   make(map[string]bool),
+		written:        make(map[string][]byte),
+		modified:       make(map[string]bool),
+		sources:        make(map[string][sha1.Size]byte),
+		run:            time.Now().Format("20060102-150405") + "-" + strconv.Itoa(os.Getpid()),
+		fileChanges:    make(map[string]map[int]int),
+		acceptedValues: make(map[string]string),
+	}
+}
+
+func (s *state) updateLineNumbers(filename string, lineNum, offset int) {
+	if offset == 0 {
+		return
+	}
+	if s.fileChanges[filename] == nil {
+		s.fileChanges[filename] = make(map[int]int)
+	}
+	s.fileChanges[filename][lineNum] += offset
+}
+
+// originalLineNumber returns line number reported by runtime.Caller for
+// the current line of rewritten file
+func (s *state) originalLineNumber(filename string, lineNum int) int {
+	var nums []int
+	for num := range s.fileChanges[filename] {
+		nums = append(nums, num)
+	}
+	sort.Ints(nums)
+	cumulativeOffset := 0
+	for _, num := range nums {
+		if lineNum-cumulativeOffset <= num {
+			break
+		}
+		cumulativeOffset += s.fileChanges[filename][num]
+	}
+	return lineNum - cumulativeOffset
+}
+
+func (s *state) currentLineNumber(filename string, lineNum int) int {
+	cumulativeOffset := 0
+	if s.fileChanges[filename] != nil {
+		for num, offset := range s.fileChanges[filename] {
+			if lineNum > num {
+				cumulativeOffset = cumulativeOffset + offset
+			}
+		}
+	}
+	return lineNum + cumulativeOffset
+}
+
+// importNames returns imports of the test file. Test file may be
+// rewritten by parallel test at the moment so read it under lock
+func (s *state) importNames(filename string) (map[string]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	src, err := readTestCode(filename)
+	if err != nil {
+		return nil, err
+	}
+	code, err := parseTestCode(filename, src)
+	if err != nil {
+		return nil, err
+	}
+	return code.importNames(), nil
+}
@@ -0,0 +1,107 @@
+package assertvalue
+
+import (
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"go/ast"
+	"os"
+	"strings"
+)
+
+// Test file may be edited after the test binary was compiled, i.e.
+// while the test waits for the answer to a prompt. runtime.Caller then
+// reports lines of the old code, so the call found at the line must
+// still have the expected value the test was compiled with
+
+// rememberSource saves hash of test file when it is seen first so later
+// changes can be detected. Caller must hold shared.mu
+func rememberSource(filename string) {
+	if _, ok := shared.sources[filename]; ok {
+		return
+	}
+	src, err := readFile(filename)
+	if err == nil {
+		shared.sources[filename] = sha1.Sum(src)
+	}
+}
+
+// sourceChanged returns true if test file was changed after the test
+// binary was compiled by someone else than assertvalue
+func sourceChanged(filename string) bool {
+	src, err := readFile(filename)
+	if err != nil {
+		return false
+	}
+	if hash, ok := shared.sources[filename]; ok && hash != sha1.Sum(src) {
+		return true
+	}
+	if shared.modified[filename] {
+		return false
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return false
+	}
+	exeInfo, err := os.Stat(exe)
+	if err != nil {
+		return false
+	}
+	info, err := os.Stat(filename)
+	return err == nil && info.ModTime().After(exeInfo.ModTime())
+}
+
+// checkStale returns error if test file was changed after the test
+// binary was compiled. The call found at the compiled line may be another
+// one then so the file must not be rewritten. Sources are remembered by
+// test binary only, accepting pending values is not checked
+func checkStale(filename string, lineNum int) error {
+	if _, ok := shared.sources[filename]; !ok || !sourceChanged(filename) {
+		return nil
+	}
+	return fmt.Errorf("Refusing to rewrite %s:%d\n%s", relPath(filename), lineNum,
+		staleMessage(filename))
+}
+
+// explainStale adds explanation to error of rewriting test file if the
+// file was changed after the test binary was compiled
+func explainStale(filename string, err error) error {
+	if !sourceChanged(filename) {
+		return err
+	}
+	return errors.New(err.Error() + "\n" + staleMessage(filename))
+}
+
+func staleMessage(filename string) string {
+	return relPath(filename) +
+		" was changed after the test was compiled. Rerun the test to accept the value"
+}
+
+// checkSource returns error if the call found in the test code does not
+// have the expected value the test was compiled with or accepted during
+// the test run. Expected value which is already updated, i.e. constant
+// shared with another call, is accepted. Go expressions of Equal are not
+// compared
+func (m *Mismatch) checkSource(c *testCode, call *ast.CallExpr) error {
+	old, accepted := shared.acceptedValues[m.callSite()]
+	if !accepted {
+		old = m.Expected
+	}
+	exists := hasExpected(call, m.Method)
+	same := exists != (m.New && !accepted)
+	if same && exists && strings.TrimPrefix(m.Func, "Check") != "Equal" {
+		decl, expr, err := c.expectedLiteral(call)
+		if err == nil {
+			value, _ := decl.expectedValue(expr)
+			text := markText(value)
+			same = text == old || text == m.Actual
+		}
+	}
+	if same {
+		return nil
+	}
+	pos := c.fset.Position(call.Pos())
+	return explainStale(c.filename, fmt.Errorf("Expected value of %s at %s:%d "+
+		"differs from the one the test was compiled with",
+		callName(m.Func, m.Method), relPath(c.filename), pos.Line))
+}
@@ -0,0 +1,201 @@
+package assertvalue
+
+import (
+	"fmt"
+	"github.com/MakeNowJust/heredoc"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Expected values of String and Value are written to the test code as
+// heredocs. Characters heredoc can't keep are replaced with markers:
+//   - <NOEOL> at the end of the last line: value has no final new line
+//   - <CR>: carriage return which Go removes from raw strings
+//   - <SP>, <TAB>: trailing space or tab which editors remove and leading
+//     one of the first line if all lines are indented
+//   - <U+000B>: leading white space other than space and tab which
+//     heredoc would take for indentation
+//   - <LT>: "<" of marker text found in the value itself
+//
+// Values which are not valid UTF-8 or contain control characters are
+// written as escaped string literals. Short single line values are written
+// as "..." literals. Heredoc wrapped with heredoc.Doc or D has no leading
+// new line but its markers are decoded too
+
+// Short values without new lines are written as "..." literals
+const maxCompactLen = 60
+
+var textMarkers = []string{"<NOEOL>", "<CR>", "<SP>", "<TAB>", "<LT>"}
+
+// decodeExpected returns value of expected argument of String or Value.
+// Wrapped is true if the argument is wrapped with heredoc.Doc or D so it
+// is heredoc content already. Heredoc starts with new line. Any other
+// string is the value itself
+func decodeExpected(expected string, wrapped bool) string {
+	if wrapped {
+		return unmarkText(expected)
+	}
+	if strings.HasPrefix(expected, "\n") {
+		return unmarkText(heredoc.Doc(expected))
+	}
+	return expected
+}
+
+// markText returns value as heredoc content with markers. It is used in
+// diffs and as Mismatch.Actual and Mismatch.Expected
+func markText(value string) string {
+	lines := strings.Split(value, "\n")
+	noEOL := value == "" || lines[len(lines)-1] != ""
+	if !noEOL {
+		lines = lines[:len(lines)-1]
+	}
+	indented := true
+	for i, line := range lines {
+		line = escapeMarkers(line)
+		line = strings.Replace(line, "\r", "<CR>", -1)
+		if r, size := utf8.DecodeRuneInString(line); unicode.IsSpace(r) && r != ' ' && r != '\t' {
+			// heredoc would remove it as indentation
+			line = runeMarker(r) + line[size:]
+		}
+		if strings.HasSuffix(line, " ") {
+			line = line[:len(line)-1] + "<SP>"
+		} else if strings.HasSuffix(line, "\t") {
+			line = line[:len(line)-1] + "<TAB>"
+		}
+		lines[i] = line
+		if line != "" && line[0] != ' ' && line[0] != '\t' {
+			indented = false
+		}
+	}
+	if indented {
+		// heredoc would remove common indentation of all lines
+		for i, line := range lines {
+			if line != "" {
+				lines[i] = markWhitespace(line[0]) + line[1:]
+				break
+			}
+		}
+	}
+	if noEOL {
+		lines[len(lines)-1] += "<NOEOL>"
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// runeMarker returns <U+XXXX> marker of rune
+func runeMarker(r rune) string {
+	return fmt.Sprintf("<U+%04X>", r)
+}
+
+func markWhitespace(c byte) string {
+	if c == '\t' {
+		return "<TAB>"
+	}
+	return "<SP>"
+}
+
+// escapeMarkers replaces "<" of marker text with <LT>
+func escapeMarkers(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '<' && markerAt(s, i) != "" {
+			b.WriteString("<LT>")
+		} else {
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String()
+}
+
+func markerAt(s string, i int) string {
+	for _, marker := range textMarkers {
+		if strings.HasPrefix(s[i:], marker) {
+			return marker
+		}
+	}
+	return runeMarkerRe.FindString(s[i:])
+}
+
+var runeMarkerRe = regexp.MustCompile(`^<U\+[0-9A-F]{4,6}>`)
+
+// unmarkText returns value of heredoc content with markers
+func unmarkText(text string) string {
+	text = strings.TrimSuffix(text, "<NOEOL>\n")
+	var b strings.Builder
+	for i := 0; i < len(text); i++ {
+		marker := markerAt(text, i)
+		switch marker {
+		case "<CR>":
+			b.WriteByte('\r')
+		case "<SP>":
+			b.WriteByte(' ')
+		case "<TAB>":
+			b.WriteByte('\t')
+		case "<LT>":
+			b.WriteByte('<')
+		case "":
+			b.WriteByte(text[i])
+			continue
+		default:
+			r, _ := strconv.ParseInt(marker[3:len(marker)-1], 16, 32)
+			b.WriteRune(rune(r))
+		}
+		i += len(marker) - 1
+	}
+	return b.String()
+}
+
+// formatExpected returns Go expression of expected value for the test
+// code. Indent is indentation of the assertion call
+func formatExpected(value, indent string) string {
+	if !strings.Contains(value, "\n") && len(value) <= maxCompactLen {
+		return strconv.Quote(value)
+	}
+	if !isPrintable(value) {
+		if strings.HasPrefix(value, "\n") {
+			// Value itself would be taken for heredoc. Write heredoc
+			// content without indentation
+			return quotedLines("\n"+markText(value), indent)
+		}
+		return quotedLines(value, indent)
+	}
+	lines := strings.Split(markText(value), "\n")
+	for i, line := range lines {
+		if line != "" {
+			lines[i] = indent + "\t" + line
+		}
+	}
+	doc := "\n" + strings.Join(lines, "\n") + indent
+	// Raw string can't contain backquotes so concatenate them
+	return "`" + strings.Replace(doc, "`", "` + \"`\" + `", -1) + "`"
+}
+
+// isPrintable returns true if s may be written as heredoc. Carriage
+// returns are replaced with markers and backquotes are concatenated
+func isPrintable(s string) bool {
+	if !utf8.ValidString(s) {
+		return false
+	}
+	for _, r := range s {
+		if !unicode.IsPrint(r) && r != '\t' && r != '\n' && r != '\r' {
+			return false
+		}
+	}
+	return true
+}
+
+// quotedLines returns concatenation of escaped string literals one per
+// line of s
+func quotedLines(s, indent string) string {
+	lines := strings.SplitAfter(s, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	for i, line := range lines {
+		lines[i] = strconv.Quote(line)
+	}
+	return strings.Join(lines, " +\n"+indent+"\t")
+}
@@ -0,0 +1,167 @@
+// Command assertvalue reviews values collected by assertvalue tests
+// running in pending mode
+//
+//	ASSERTVALUE_PENDING=1 go test ./...
+//	go run github.com/smetana/assert_value_go/cmd/assertvalue review
+//
+// Accepted values are written to the test code or golden files the same
+// way as when they are accepted during the test run.
+//
+// Edits of accepted values are journaled and can be reverted
+//
+//	go run github.com/smetana/assert_value_go/cmd/assertvalue undo
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"github.com/smetana/assert_value_go/assertvalue"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const usage = `Usage:
+
+	assertvalue review [-dir dir]
+	assertvalue undo [-list] [id...]
+
+Commands:
+
+	review    ask to accept or reject pending values
+	undo      revert edits of the last test run or edits with given ids
+`
+
+func main() {
+	log.SetFlags(0)
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	switch os.Args[1] {
+	case "review":
+		review(os.Args[2:])
+	case "undo":
+		undo(os.Args[2:])
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+}
+
+func review(args []string) {
+	flags := flag.NewFlagSet("review", flag.ExitOnError)
+	dir := flags.String("dir", "", "pending values directory "+
+		"(default .assertvalue/pending in module root)")
+	flags.Parse(args)
+	if *dir == "" {
+		*dir = assertvalue.PendingDir(".")
+	}
+
+	mismatches, err := assertvalue.ReadPending(*dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(mismatches) == 0 {
+		fmt.Println("No pending values")
+		return
+	}
+
+	in := bufio.NewReader(os.Stdin)
+	accepted, rejected := 0, 0
+	for i, m := range mismatches {
+		fmt.Printf("--- %s:%d %s\n", relPath(m.Source), m.Line, m.Test)
+		fmt.Println(m.Diff)
+		fmt.Printf("(%d/%d) Accept new value? [y,n,s,q] ", i+1, len(mismatches))
+		answer, err := in.ReadString('\n')
+		if err == io.EOF && answer == "" {
+			fmt.Println()
+			break
+		} else if err != nil && err != io.EOF {
+			log.Fatal(err)
+		}
+		answer = strings.TrimSpace(answer)
+		fmt.Println(answer)
+		if answer == "q" {
+			break
+		}
+		switch answer {
+		case "y":
+			err = m.Accept()
+			accepted++
+		case "n":
+			err = m.Discard()
+			rejected++
+		default:
+			// Skip. Leave value pending
+			err = nil
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	skipped := len(mismatches) - accepted - rejected
+	fmt.Printf("%d accepted, %d rejected, %d left pending\n", accepted, rejected, skipped)
+}
+
+func undo(args []string) {
+	flags := flag.NewFlagSet("undo", flag.ExitOnError)
+	list := flags.Bool("list", false, "list journaled edits")
+	flags.Parse(args)
+
+	entries, err := assertvalue.ReadJournal(".")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *list {
+		for _, e := range entries {
+			fmt.Printf("%d\t%s\t%s\t%s\n", e.ID,
+				e.Time.Format("2006-01-02 15:04:05"), e.File, e.Test)
+		}
+		return
+	}
+
+	edits := assertvalue.LastRun(entries)
+	if flags.NArg() > 0 {
+		byID := make(map[int]*assertvalue.JournalEntry)
+		for _, e := range entries {
+			byID[e.ID] = e
+		}
+		edits = nil
+		for _, arg := range flags.Args() {
+			id, err := strconv.Atoi(arg)
+			if err != nil || byID[id] == nil {
+				log.Fatalf("No journaled edit %s", arg)
+			}
+			edits = append(edits, byID[id])
+		}
+	}
+	if len(edits) == 0 {
+		fmt.Println("Nothing to undo")
+		return
+	}
+	err = assertvalue.Undo(".", edits)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, e := range edits {
+		fmt.Printf("Reverted %d\t%s\t%s\n", e.ID, e.File, e.Test)
+	}
+}
+
+// relPath returns path relative to current directory if possible
+func relPath(path string) string {
+	wd, err := os.Getwd()
+	if err != nil {
+		return path
+	}
+	rel, err := filepath.Rel(wd, path)
+	if err != nil {
+		return path
+	}
+	return rel
+}
@@ -15,6 +15,7 @@ import (
 	"os"
 	"os/exec"
 	"regexp"
+	"strings"
 	"syscall"
 	"testing"
 )
@@ -23,6 +24,7 @@ var (
 	tmpDir   string
 	canonRe1 *regexp.Regexp
 	canonRe2 *regexp.Regexp
+	canonRe3 *regexp.Regexp
 )
 
 // ----------------- Tests -------------------
@@ -48,11 +50,404 @@ func TestFail(t *testing.T) {
 	runTestFile(t, "fail_test", false)
 }
 
+func TestCallShapes(t *testing.T) {
+	runTestFile(t, "call_shapes_test", true)
+}
+
+func TestValue(t *testing.T) {
+	runTestFile(t, "value_test", true)
+}
+
+func TestEqual(t *testing.T) {
+	runTestFile(t, "equal_test", true)
+}
+
+func TestText(t *testing.T) {
+	runTestFile(t, "text_test", true)
+	// Accepted values must match actual values exactly
+	runCommand(t, "", "go", "test", "text_test.go", "-args", "-assertvalue.interactive=false")
+}
+
+func TestVerify(t *testing.T) {
+	os.RemoveAll(tmpDir + "/.assertvalue/pending")
+	// Written values do not decode to the accepted ones
+	copyPath("test/verify_encoding.inject", "assertvalue/verify_encoding.go")
+	defer os.Remove(tmpDir + "/assertvalue/verify_encoding.go")
+	runTestFile(t, "verify_test", false)
+	os.Remove(tmpDir + "/assertvalue/verify_encoding.go")
+	// Refused values are saved as pending and may be accepted later
+	out := runCommand(t, "y\ny\n", "go", "run", "./cmd/assertvalue", "review")
+	assertvalue.File(t, out, "test/verify_test.review")
+	testCode, err := ioutil.ReadFile(tmpDir + "/verify_test.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertvalue.File(t, string(testCode), "test/verify_test.reviewed")
+}
+
+func TestStale(t *testing.T) {
+	runTestFile(t, "stale_test", false)
+	runTestFile(t, "stale_calls_test", false)
+}
+
+func TestImports(t *testing.T) {
+	runTestFile(t, "imports_alias_test", true)
+	runTestFile(t, "imports_dot_test", true)
+}
+
+func TestImportsDottedPackage(t *testing.T) {
+	err := os.MkdirAll(tmpDir+"/dotted.v2", 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copyPath("test/dotted_test.before", "dotted.v2/dotted_test.go")
+	prompts := getPrompts("dotted.v2/dotted_test.go")
+	runCommand(t, "", "go", "test", "-v", "./dotted.v2", "-args", "-assertvalue.prompts="+prompts)
+	testCode, err := ioutil.ReadFile(tmpDir + "/dotted.v2/dotted_test.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertvalue.File(t, string(testCode), "test/dotted_test.after")
+}
+
+func TestConst(t *testing.T) {
+	copyPath("test/const_ignored_test.before", "const_ignored_test.go")
+	// Expected values are declared in both files
+	out := runTestPackage(t, []string{"const_test", "const_decl_test"}, true)
+	assertvalue.File(t, out, "test/const_test.output")
+	runCommand(t, "", "go", "test", "const_test.go", "const_decl_test.go",
+		"-args", "-assertvalue.interactive=false")
+	ignored, err := ioutil.ReadFile(tmpDir + "/const_ignored_test.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertvalue.File(t, string(ignored), "test/const_ignored_test.before")
+
+	// Constants of production code are not rewritten
+	out = runTestPackage(t, []string{"const_prod_test", "const_prod"}, false)
+	assertvalue.File(t, out, "test/const_prod_test.output")
+}
+
+func TestCheck(t *testing.T) {
+	runTestFile(t, "check_test", false)
+}
+
+func TestTB(t *testing.T) {
+	os.Remove(tmpDir + "/tb_file_a.txt")
+	os.Remove(tmpDir + "/tb_file_b.txt")
+	runTestFile(t, "tb_test", true)
+	// Accepted values and golden files match actual values
+	runCommand(t, "", "go", "test", "tb_test.go", "-args", "-assertvalue.interactive=false")
+}
+
+func TestSession(t *testing.T) {
+	runTestFile(t, "session_test", true)
+}
+
+func TestParallel(t *testing.T) {
+	// Order of prompts is not defined so compare only resulting code
+	runTestCode(t, "parallel_test", true)
+}
+
+func TestPending(t *testing.T) {
+	runTestFile(t, "pending_test", false, "-assertvalue.pending-dir=pending")
+	out := runCommand(t, "y\nn\ny\ny\ns\n",
+		"go", "run", "./cmd/assertvalue", "review", "-dir", "pending")
+	assertvalue.File(t, out, "test/pending_test.review")
+
+	testCode, err := ioutil.ReadFile(tmpDir + "/pending_test.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertvalue.File(t, string(testCode), "test/pending_test.reviewed")
+
+	// Skipped value is still pending
+	out = runCommand(t, "y\n",
+		"go", "run", "./cmd/assertvalue", "review", "-dir", "pending")
+	assertvalue.File(t, out, "test/pending_test.review2")
+	content, err := ioutil.ReadFile(tmpDir + "/pending_file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertvalue.String(t, string(content), `
+		Hello World!
+	`)
+}
+
+func TestUndo(t *testing.T) {
+	os.Remove(tmpDir + "/.assertvalue/journal.jsonl")
+	err := ioutil.WriteFile(tmpDir+"/undo_utf8.txt", []byte("café\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(tmpDir+"/undo_binary.bin", []byte("\xff\x00\x02"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runTestFile(t, "undo_test", true)
+	out := runCommand(t, "", "go", "run", "./cmd/assertvalue", "undo", "-list")
+	out = regexp.MustCompile(`\d{4}-\d\d-\d\d \d\d:\d\d:\d\d`).ReplaceAllString(out, "<time>")
+	assertvalue.String(t, out, `
+		1	<time>	undo_test.go	TestAcceptAll
+		2	<time>	undo_test.go	TestAcceptAll
+		3	<time>	undo_file.txt	TestAcceptAll
+		4	<time>	undo_utf8.txt	TestAcceptAll
+		5	<time>	undo_binary.bin	TestAcceptAll
+	`)
+
+	out = runCommand(t, "", "go", "run", "./cmd/assertvalue", "undo", "2")
+	assertvalue.String(t, out, `
+		Reverted 2	undo_test.go	TestAcceptAll
+	`)
+	testCode, err := ioutil.ReadFile(tmpDir + "/undo_test.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertvalue.File(t, string(testCode), "test/undo_test.undo1")
+
+	// Revert the rest of the last run
+	out = runCommand(t, "", "go", "run", "./cmd/assertvalue", "undo")
+	assertvalue.String(t, out, `
+		Reverted 1	undo_test.go	TestAcceptAll
+		Reverted 3	undo_file.txt	TestAcceptAll
+		Reverted 4	undo_utf8.txt	TestAcceptAll
+		Reverted 5	undo_binary.bin	TestAcceptAll
+	`)
+	testCode, err = ioutil.ReadFile(tmpDir + "/undo_test.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertvalue.File(t, string(testCode), "test/undo_test.before")
+	_, err = os.Stat(tmpDir + "/undo_file.txt")
+	assertvalue.Equal(t, os.IsNotExist(err), true)
+	content, err := ioutil.ReadFile(tmpDir + "/undo_utf8.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertvalue.String(t, string(content), "café\n")
+	content, err = ioutil.ReadFile(tmpDir + "/undo_binary.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertvalue.String(t, string(content), "\xff\x00\x02")
+
+	out = runCommand(t, "", "go", "run", "./cmd/assertvalue", "undo")
+	assertvalue.String(t, out, `
+		Nothing to undo
+	`)
+}
+
+func TestPrompt(t *testing.T) {
+	runTestFile(t, "prompt_test", false)
+	runTestFile(t, "prompt_file_test", false)
+}
+
+func TestEdit(t *testing.T) {
+	// Editor replaces volatile value with placeholder
+	defer setenv("VISUAL", "sed -i s/World/Placeholder/")()
+	runTestFile(t, "edit_test", false)
+	content, err := ioutil.ReadFile(tmpDir + "/edit_file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertvalue.String(t, string(content), `
+		Hello Placeholder
+	`)
+}
+
+func TestHunks(t *testing.T) {
+	copyPath("test/hunks_file.before", "hunks_file.txt")
+	runTestFile(t, "hunks_test", false)
+	content, err := ioutil.ReadFile(tmpDir + "/hunks_file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertvalue.File(t, string(content), "test/hunks_file.after")
+}
+
+func TestPrompter(t *testing.T) {
+	runTestFile(t, "prompter_test", false)
+}
+
+func TestConfig(t *testing.T) {
+	restoreInteractive := setenv("ASSERTVALUE_INTERACTIVE", "false")
+	restoreAccept := setenv("ASSERTVALUE_ACCEPT", "1")
+	runTestFile(t, "config_test", true)
+	restoreInteractive()
+	restoreAccept()
+
+	// Not interactive on CI even in verbose mode
+	defer setenv("CI", "true")()
+	runTestFile(t, "config_ci_test", false)
+
+	// Legacy arguments
+	runTestFile(t, "config_legacy_test", true, "--", "-nointeractive", "-accept")
+}
+
+func TestPolicy(t *testing.T) {
+	runTestFile(t, "policy_new_test", false,
+		"-assertvalue.interactive=false", "-assertvalue.accept=new")
+	runTestFile(t, "policy_run_test", false,
+		"-assertvalue.accept-run=Selected")
+	runTestFile(t, "policy_file_test", false,
+		"-assertvalue.interactive=false", "-assertvalue.accept-file=*_golden.txt")
+	_, err := os.Stat(tmpDir + "/policy_new.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = os.Stat(tmpDir + "/policy_golden.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = os.Stat(tmpDir + "/policy_other.txt")
+	if !os.IsNotExist(err) {
+		t.Fatal("policy_other.txt must not be created")
+	}
+}
+
+func TestStrict(t *testing.T) {
+	// Strict mode never creates expected values even if asked to
+	runTestFile(t, "strict_test", false,
+		"-assertvalue.strict", "-assertvalue.interactive=false", "-assertvalue.accept")
+	_, err := os.Stat(tmpDir + "/strict_file.txt")
+	if !os.IsNotExist(err) {
+		t.Fatal("strict_file.txt must not be created")
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	copyPath("test/dryrun_file.before", "dryrun_file.txt")
+	// Patch of earlier run is replaced
+	err := ioutil.WriteFile(tmpDir+"/dryrun.patch", []byte(
+		"# assertvalue patch of go test process 1\n"+
+			"diff --git a/dryrun_stale.txt b/dryrun_stale.txt\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runTestFile(t, "dryrun_test", true, "-assertvalue.patch=dryrun.patch",
+		"-assertvalue.interactive=false", "-assertvalue.accept")
+	_, err = os.Stat(tmpDir + "/dryrun_new.txt")
+	if !os.IsNotExist(err) {
+		t.Fatal("dryrun_new.txt must not be created")
+	}
+	patch, err := ioutil.ReadFile(tmpDir + "/dryrun.patch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Header has process id of go command
+	patch = regexp.MustCompile(`process \d+`).ReplaceAll(patch, []byte("process 0"))
+	assertvalue.File(t, string(patch), "test/dryrun_test.patch")
+
+	runCommand(t, "", "git", "apply", "dryrun.patch")
+	testCode, err := ioutil.ReadFile(tmpDir + "/dryrun_test.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertvalue.File(t, string(testCode), "test/dryrun_test.applied")
+	content, err := ioutil.ReadFile(tmpDir + "/dryrun_file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertvalue.String(t, string(content), `
+		line 1
+		line two
+		line 3<NOEOL>
+	`)
+	content, err = ioutil.ReadFile(tmpDir + "/dryrun_new.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertvalue.String(t, string(content), `
+		Hello
+		World<NOEOL>
+	`)
+}
+
+func TestEncoding(t *testing.T) {
+	err := ioutil.WriteFile(tmpDir+"/encoding_golden.txt", []byte("old\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Symlink("encoding_golden.txt", tmpDir+"/encoding_link.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	runTestFile(t, "encoding_test", true)
+
+	info, err := os.Lstat(tmpDir + "/encoding_link.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertvalue.Equal(t, info.Mode()&os.ModeSymlink != 0, true)
+	info, err = os.Stat(tmpDir + "/encoding_golden.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertvalue.Equal(t, info.Mode().Perm(), os.FileMode(0600))
+	content, err := ioutil.ReadFile(tmpDir + "/encoding_golden.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertvalue.String(t, string(content), `
+		new
+	`)
+}
+
+func TestGit(t *testing.T) {
+	defer os.RemoveAll(tmpDir + "/.git")
+	copyPath("test/git_test.before", "git_test.go")
+	for _, name := range []string{"git_clean.txt", "git_unstaged.txt"} {
+		err := ioutil.WriteFile(tmpDir+"/"+name, []byte("old\n"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	runCommand(t, "", "git", "init", "-q")
+	runCommand(t, "", "git", "add", "git_test.go", "git_clean.txt", "git_unstaged.txt")
+	runCommand(t, "", "git", "-c", "user.name=test", "-c", "user.email=test@example.com",
+		"commit", "-q", "-m", "init")
+	err := ioutil.WriteFile(tmpDir+"/git_unstaged.txt", []byte("edited\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	runTestFile(t, "git_test", false, "-assertvalue.stage",
+		"-assertvalue.interactive=false", "-assertvalue.accept")
+	out := runCommand(t, "", "git", "status", "--porcelain", "--",
+		"git_test.go", "git_clean.txt", "git_unstaged.txt")
+	assertvalue.String(t, out, `
+		M  git_clean.txt
+		M  git_test.go
+		 M git_unstaged.txt
+	`)
+}
+
+func TestPromptLock(t *testing.T) {
+	// Pretend test binary of another package is prompting
+	err := os.MkdirAll(tmpDir+"/.assertvalue", 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Create(tmpDir + "/.assertvalue/prompt.lock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+	runTestFile(t, "prompt_lock_test", false, "-assertvalue.nowait")
+}
+
 // ----------------- Helpers -----------------
 
 func init() {
 	canonRe1 = regexp.MustCompile(`((ok|FAIL)\s+command-line-arguments\s*)(.*)`)
-	canonRe2 = regexp.MustCompile(`((PASS|FAIL):\s+Test.*\s+)\(.*?\)`)
+	canonRe2 = regexp.MustCompile(`((PASS|FAIL):\s+(Test|Fuzz).*\s+)\(.*?\)`)
+	// Newer go versions print extra FAIL line after failed package summary
+	canonRe3 = regexp.MustCompile(`(?m)^(FAIL\s+command-line-arguments.*\n)FAIL\n`)
 }
 
 func TestMain(m *testing.M) {
@@ -65,6 +460,7 @@ func TestMain(m *testing.M) {
 		"go.mod",
 		"go.sum",
 		"assertvalue",
+		"cmd",
 		"vendor",
 	}
 	for _, path := range pathsToCopy {
@@ -76,18 +472,34 @@ func TestMain(m *testing.M) {
 	os.Exit(code)
 }
 
-func runTestFile(t *testing.T, testName string, shouldPass bool) {
+func runTestFile(t *testing.T, testName string, shouldPass bool, args ...string) {
+	out := runTestCode(t, testName, shouldPass, args...)
+	assertvalue.File(t, out, "test/"+testName+".output")
+}
+
+// runTestCode runs test, compares resulting test code with *_test.after
+// and returns canonicalized test run output
+func runTestCode(t *testing.T, testName string, shouldPass bool, args ...string) string {
+	return runTestPackage(t, []string{testName}, shouldPass, args...)
+}
+
+// runTestPackage is runTestCode for test consisting of several files
+func runTestPackage(t *testing.T, testNames []string, shouldPass bool, args ...string) string {
 	var stdout bytes.Buffer
 	var stderr bytes.Buffer
-	beforeFilename := "test/" + testName + ".before"
-	afterFilename := "test/" + testName + ".after"
-	outputFilename := "test/" + testName + ".output"
-	testFilename := testName + ".go"
-
-	copyPath(beforeFilename, testFilename)
-	prompts := getPrompts(testFilename)
-	cmd := exec.Command("go", "test", "-v", testFilename,
-		"-args", "--", "-prompts="+prompts,
+	var testFilenames []string
+	prompts := ""
+	for _, testName := range testNames {
+		testFilename := testName + ".go"
+		copyPath("test/"+testName+".before", testFilename)
+		prompts += getPrompts(testFilename)
+		testFilenames = append(testFilenames, testFilename)
+	}
+	testFilename := testFilenames[0]
+
+	cmdArgs := append([]string{"test", "-v"}, testFilenames...)
+	cmd := exec.Command("go", append(append(cmdArgs,
+		"-args", "-assertvalue.prompts="+prompts), args...)...,
 	)
 	cmd.Dir = tmpDir
 	cmd.Env = append(os.Environ(),
@@ -115,13 +527,49 @@ func runTestFile(t *testing.T, testName string, shouldPass bool) {
 			}
 		}
 	}
-	testCode, err := ioutil.ReadFile(tmpDir + "/" + testFilename)
+	for _, testName := range testNames {
+		testCode, err := ioutil.ReadFile(tmpDir + "/" + testName + ".go")
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertvalue.File(t, string(testCode), "test/"+testName+".after")
+	}
+	return canonicalizeOutput(stdout.String())
+}
+
+// setenv sets environment variable and returns function restoring it
+func setenv(key, value string) func() {
+	old, ok := os.LookupEnv(key)
+	os.Setenv(key, value)
+	return func() {
+		if ok {
+			os.Setenv(key, old)
+		} else {
+			os.Unsetenv(key)
+		}
+	}
+}
+
+// runCommand runs command in temporary directory with input as stdin
+// and returns its output
+func runCommand(t *testing.T, input string, name string, args ...string) string {
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+	cmd := exec.Command(name, args...)
+	cmd.Dir = tmpDir
+	cmd.Env = append(os.Environ(),
+		"GOFLAGS=-mod=vendor",
+	)
+	cmd.Stdin = strings.NewReader(input)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
 	if err != nil {
+		t.Log(stdout.String())
+		t.Log(stderr.String())
 		t.Fatal(err)
 	}
-	out := canonicalizeOutput(stdout.String())
-	assertvalue.File(t, string(testCode), afterFilename)
-	assertvalue.File(t, out, outputFilename)
+	return stdout.String()
 }
 
 func copyPath(in, out string) {
@@ -137,7 +585,7 @@ func getPrompts(in string) string {
 	if err != nil {
 		log.Fatal(err)
 	}
-	re := regexp.MustCompile(`prompt[\s:=]*([ynYN]*)`)
+	re := regexp.MustCompile(`prompt[\s:=]*([ynYNarsqhed?]*)`)
 	matches := re.FindAllStringSubmatch(string(testCode), -1)
 	prompts := ""
 	for _, match := range matches {
@@ -149,5 +597,6 @@ func getPrompts(in string) string {
 func canonicalizeOutput(s string) string {
 	s = canonRe1.ReplaceAllString(s, "${1}0000s")
 	s = canonRe2.ReplaceAllString(s, "${1}(0000s)")
+	s = canonRe3.ReplaceAllString(s, "${1}")
 	return s
 }